@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -10,17 +11,20 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"runtime"
 	"runtime/debug"
 	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	oklogrun "github.com/oklog/run"
 	"github.com/parca-dev/parca-agent/pkg/agent"
 	"github.com/parca-dev/parca-agent/pkg/debuginfo"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
 	parcadebuginfo "github.com/parca-dev/parca/pkg/debuginfo"
 	"github.com/prometheus/client_golang/prometheus"
@@ -44,8 +48,40 @@ type flags struct {
 	LogLevel    string `kong:"enum='error,warn,info,debug',help='Log level.',default='info'"`
 	HTTPAddress string `kong:"help='Address to bind HTTP server to.',default=':6060'"`
 
-	Node              string        `kong:"default='localhost',help='Name node the process is running on. Used to identify the process.'"`
-	ProfilingDuration time.Duration `kong:"help='The agent profiling duration to use. Leave this empty to use the defaults.',default='10s'"`
+	Node                       string        `kong:"default='localhost',help='Name node the process is running on. Used to identify the process.'"`
+	ProfilingDuration          time.Duration `kong:"help='The agent profiling duration to use. Leave this empty to use the defaults.',default='10s'"`
+	SamplingFrequency          uint64        `kong:"help='The frequency in Hz to sample stacks at. Limited by kernel.perf_event_max_sample_rate.',default='100'"`
+	MaxStackDepth              int           `kong:"help='The depth to walk stacks to, up to 127 frames. Deeper kernel and user stacks get a [truncated] frame where they are cut.',default='127'"`
+	SampleStreaming            bool          `kong:"help='Stream CPU samples with their stacks through a BPF ring buffer, or a perf buffer on older kernels, instead of counting them in a fixed size BPF map.'"`
+	SampleStreamingMemoryLimit string        `kong:"help='Memory the streamed samples of a profiling window may take. Samples of new stacks are dropped beyond it.',default='64MiB'"`
+	OffCPUProfiling            bool          `kong:"name='off-cpu-profiling',help='Also profile the time tasks spend blocked off-CPU.'"`
+	HeapProfiling              bool          `kong:"help='Also profile native heap allocations through uprobes on the libc allocator.'"`
+	GoAllocProfiling           bool          `kong:"help='Also profile allocations of Go binaries through uprobes on runtime.mallocgc.'"`
+	DWARFUnwinding             bool          `kong:"name='dwarf-unwinding',help='Walk user stacks of processes built without frame pointers using .eh_frame/.debug_frame. Only supported on x86_64.'"`
+	PerfEvent                  string        `kong:"enum='cpu-clock,page-faults,context-switches,cpu-migrations,cpu-cycles,instructions,cache-misses,branch-misses',help='Perf event to sample stacks on. Hardware events need a PMU.',default='cpu-clock'"`
+	PerfEventPeriod            uint64        `kong:"help='Sample every N occurrences of events other than cpu-clock, which is sampled at the sampling frequency instead. Leave this empty to use the default of the event.'"`
+	BTFPath                    string        `kong:"name='btf-path',help='BTF file describing the types of the running kernel, for kernels without /sys/kernel/btf/vmlinux.'"`
+	BTFArchiveDir              string        `kong:"name='btf-archive-dir',help='Directory of uncompressed BTF files named after kernel releases, flat or laid out like BTFHub, to look up the BTF of kernels without /sys/kernel/btf/vmlinux in.'"`
+
+	Symbolization      string   `kong:"enum='local,kernel,none',help='Where functions are resolved. One of: local, to resolve everything on the node, kernel, to only resolve the kernel and JIT frames the server cannot, none.',default='local'"`
+	Demangle           string   `kong:"enum='full,simplified,none',help='How C++ and Rust function names are demangled. One of: full, simplified, to drop template and function parameters, none.',default='simplified'"`
+	DebuginfodURLs     []string `kong:"name='debuginfod-url',help='URL of a debuginfod server to fetch the debug info of stripped binaries from. Servers are asked in order.'"`
+	DebuginfodCacheDir string   `kong:"name='debuginfod-cache-dir',help='The local directory to cache debug info fetched from debuginfod servers in.',default='./tmp/debuginfod'"`
+
+	TargetMode string `kong:"enum='all,go,pids',help='Processes to profile. One of: all, go, pids.',default='all'"`
+	TargetPIDs []int  `kong:"name='target-pid',help='PIDs of the processes to profile when the target mode is pids.'"`
+
+	FilterPIDs         []int    `kong:"name='filter-pid',help='Only stack-walk these PIDs in the kernel. Can be combined with the other filters.'"`
+	FilterCommPrefixes []string `kong:"name='filter-comm',help='Only stack-walk tasks whose command name starts with this prefix in the kernel.'"`
+	FilterCgroups      []string `kong:"name='filter-cgroup',help='Only stack-walk tasks in this cgroup v2 directory in the kernel.'"`
+	FilterHTTPAddress  string   `kong:"name='filter-http-address',help='Address to serve the /filter endpoint on, to read and replace the filters at runtime. It is unauthenticated, so bind it to a trusted interface. Disabled when empty.'"`
+
+	KubernetesMetadataSource  string   `kong:"enum='none,kubelet,cri',help='Source of Kubernetes pod metadata. One of: none, kubelet, cri.',default='none'"`
+	KubeletURL                string   `kong:"help='Kubelet URL to list pods from.',default='https://127.0.0.1:10250'"`
+	KubeletBearerTokenFile    string   `kong:"help='File to read bearer token from to authenticate with the kubelet.'"`
+	KubeletInsecureSkipVerify bool     `kong:"help='Skip TLS certificate verification of the kubelet.'"`
+	CRISocket                 string   `kong:"name='cri-socket',help='CRI socket to query pod metadata from.',default='/run/containerd/containerd.sock'"`
+	KubernetesPodLabels       []string `kong:"name='kubernetes-pod-label',help='Pod label to attach to the profiles of the processes running in the pod.'"`
 
 	LocalStoreDirectory string `kong:"help='The local directory to store the profiling data.',default='./tmp/profiles'"`
 
@@ -104,6 +140,100 @@ func run(logger log.Logger, reg prometheus.Registerer, mux *http.ServeMux, flags
 		opts []profiler.Option
 	)
 
+	opts = append(opts, profiler.WithRegisterer(reg))
+	opts = append(opts, profiler.WithSamplingFrequency(flags.SamplingFrequency))
+	opts = append(opts, profiler.WithMaxStackDepth(flags.MaxStackDepth))
+	memoryLimit, err := humanize.ParseBytes(flags.SampleStreamingMemoryLimit)
+	if err != nil {
+		return fmt.Errorf("invalid sample streaming memory limit: %w", err)
+	}
+	opts = append(opts, profiler.WithSampleStreaming(flags.SampleStreaming, memoryLimit))
+	opts = append(opts, profiler.WithOffCPUProfiling(flags.OffCPUProfiling))
+	opts = append(opts, profiler.WithHeapProfiling(flags.HeapProfiling))
+	opts = append(opts, profiler.WithGoAllocProfiling(flags.GoAllocProfiling))
+
+	if flags.DWARFUnwinding && runtime.GOARCH != "amd64" {
+		return errors.New("DWARF unwinding is only supported on x86_64")
+	}
+	opts = append(opts, profiler.WithDWARFUnwinding(flags.DWARFUnwinding))
+
+	perfEvent, err := profiler.ParsePerfEvent(flags.PerfEvent)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, profiler.WithPerfEvent(perfEvent, flags.PerfEventPeriod))
+	opts = append(opts, profiler.WithBTF(flags.BTFPath, flags.BTFArchiveDir))
+
+	// The object file cache is shared by the profiler and the symbolizer, to open every object file once.
+	objFileCache := objectfile.NewCache(10)
+	opts = append(opts, profiler.WithObjectFileCache(objFileCache))
+
+	var debuginfod *profiler.DebuginfodClient
+	if len(flags.DebuginfodURLs) > 0 {
+		debuginfod = profiler.NewDebuginfodClient(logger, flags.DebuginfodURLs, flags.DebuginfodCacheDir)
+	}
+
+	switch flags.Symbolization {
+	case "kernel":
+		opts = append(opts, profiler.WithSymbolizer(profiler.NewChainSymbolizer(
+			profiler.NewKernelSymbolizer(logger),
+			profiler.NewJITSymbolizer(logger),
+		)))
+	case "none":
+		opts = append(opts, profiler.WithSymbolizer(profiler.NewNoopSymbolizer()))
+	default:
+		opts = append(opts, profiler.WithSymbolizer(profiler.NewLocalSymbolizer(logger, objFileCache, debuginfod)))
+	}
+
+	demangleMode, err := profiler.ParseDemangleMode(flags.Demangle)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, profiler.WithDemangling(demangleMode))
+
+	targetMode, err := profiler.ParseTargetMode(flags.TargetMode)
+	if err != nil {
+		return err
+	}
+	if targetMode == profiler.TargetPIDs && len(flags.TargetPIDs) == 0 {
+		return errors.New("target mode pids requires at least one --target-pid")
+	}
+	opts = append(opts, profiler.WithTargets(targetMode, flags.TargetPIDs))
+
+	filter := profiler.Filter{
+		PIDs:         flags.FilterPIDs,
+		CommPrefixes: flags.FilterCommPrefixes,
+	}
+	for _, path := range flags.FilterCgroups {
+		id, err := profiler.CgroupID(path)
+		if err != nil {
+			return err
+		}
+		filter.CgroupIDs = append(filter.CgroupIDs, id)
+	}
+	opts = append(opts, profiler.WithFilter(filter))
+
+	switch flags.KubernetesMetadataSource {
+	case "kubelet":
+		var token string
+		if flags.KubeletBearerTokenFile != "" {
+			b, err := ioutil.ReadFile(flags.KubeletBearerTokenFile)
+			if err != nil {
+				return fmt.Errorf("failed to read kubelet bearer token from file: %w", err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		provider := profiler.NewKubeletPodProvider(flags.KubeletURL, token, flags.KubeletInsecureSkipVerify)
+		opts = append(opts, profiler.WithPodMetadataProvider(provider, flags.KubernetesPodLabels))
+	case "cri":
+		provider, err := profiler.NewCRIPodProvider(flags.CRISocket)
+		if err != nil {
+			return err
+		}
+		defer provider.Close()
+		opts = append(opts, profiler.WithPodMetadataProvider(provider, flags.KubernetesPodLabels))
+	}
+
 	if flags.LocalStoreDirectory != "" {
 		opts = append(opts, profiler.WithProfileWriter(profiler.NewFileWriter(flags.LocalStoreDirectory)))
 	}
@@ -147,6 +277,22 @@ func run(logger log.Logger, reg prometheus.Registerer, mux *http.ServeMux, flags
 		}, func(error) {
 			cancel()
 		})
+
+		// The filter endpoint changes what's profiled, so it's kept off the metrics listener.
+		if flags.FilterHTTPAddress != "" {
+			filterMux := http.NewServeMux()
+			filterMux.HandleFunc("/filter", filterHandler(profiler))
+
+			ln, err := net.Listen("tcp", flags.FilterHTTPAddress)
+			if err != nil {
+				return err
+			}
+			g.Add(func() error {
+				return http.Serve(ln, filterMux)
+			}, func(error) {
+				ln.Close()
+			})
+		}
 	}
 
 	{
@@ -166,6 +312,33 @@ func run(logger log.Logger, reg prometheus.Registerer, mux *http.ServeMux, flags
 	return g.Run()
 }
 
+// filterHandler reports the in-kernel target filter on GET and replaces it on PUT.
+func filterHandler(p *profiler.Profiler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var f profiler.Filter
+			if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := p.SetFilter(f); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.Filter()); err != nil {
+			level.Warn(logger).Log("msg", "failed to encode filter", "err", err)
+		}
+	}
+}
+
 const (
 	logFormatLogfmt = "logfmt"
 	LogFormatJSON   = "json"
@@ -0,0 +1,47 @@
+package profiler
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+)
+
+const maxStackDepthConstName = "max_stack_depth"
+
+// setConstant returns a copy of the given BPF object file in which the read-only global
+// variable with the given name is set to the given value. Read-only globals are loaded
+// from the .rodata section, so the verifier knows their values.
+func setConstant(obj []byte, name string, value uint32) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return nil, fmt.Errorf("open bpf object: %w", err)
+	}
+	defer f.Close()
+
+	syms, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, fmt.Errorf("read bpf object symbols: %w", err)
+	}
+	for _, sym := range syms {
+		if sym.Name != name {
+			continue
+		}
+		if int(sym.Section) >= len(f.Sections) || f.Sections[sym.Section].Name != ".rodata" {
+			return nil, fmt.Errorf("%s is not a read-only global", name)
+		}
+		if sym.Size != 4 {
+			return nil, fmt.Errorf("%s is not a 32 bit global", name)
+		}
+		sec := f.Sections[sym.Section]
+		if sym.Value+sym.Size > sec.Size {
+			return nil, fmt.Errorf("%s is out of its section", name)
+		}
+
+		patched := make([]byte, len(obj))
+		copy(patched, obj)
+		f.ByteOrder.PutUint32(patched[sec.Offset+sym.Value:], value)
+		return patched, nil
+	}
+	return nil, fmt.Errorf("global %s not found", name)
+}
@@ -0,0 +1,57 @@
+package profiler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelBTFPath is where kernels built with CONFIG_DEBUG_INFO_BTF expose their BTF.
+const kernelBTFPath = "/sys/kernel/btf/vmlinux"
+
+// btfObjPath returns the BTF file the BPF object is loaded with, an empty path lets libbpf use the BTF of the
+// running kernel. A given file is always used. Otherwise, on kernels without BTF, the file of the running kernel
+// release is looked up in the archive directory.
+func btfObjPath(path, archiveDir string) (string, error) {
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("stat BTF file: %w", err)
+		}
+		return path, nil
+	}
+	if _, err := os.Stat(kernelBTFPath); err == nil || archiveDir == "" {
+		return "", nil
+	}
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return "", fmt.Errorf("get kernel release: %w", err)
+	}
+	release := unix.ByteSliceToString(uname.Release[:])
+	return findArchivedBTF(archiveDir, release)
+}
+
+// findArchivedBTF returns the uncompressed BTF file of the given kernel release in the archive directory,
+// either right in it, e.g. 4.18.0-305.el8.x86_64.btf, or laid out like the BTFHub archive,
+// e.g. centos/8/x86_64/4.18.0-305.el8.x86_64.btf.
+func findArchivedBTF(archiveDir, release string) (string, error) {
+	name := release + ".btf"
+	path := filepath.Join(archiveDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("stat BTF file: %w", err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(archiveDir, "*", "*", "*", name))
+	if err != nil {
+		return "", fmt.Errorf("search BTF archive: %w", err)
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no BTF file for kernel release %s in %s", release, archiveDir)
+	}
+	return matches[0], nil
+}
@@ -0,0 +1,195 @@
+package profiler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroupHybridRoot is where the unified hierarchy is mounted on hosts running cgroup v1 and v2 side by side.
+	cgroupHybridRoot = "/sys/fs/cgroup/unified"
+
+	// cgroupRescanInterval limits how often the cgroup hierarchy is walked when an unknown ID shows up.
+	cgroupRescanInterval = 10 * time.Second
+)
+
+// containerIDRegexp matches the last component of the cgroup paths created by
+// docker (docker-<id>.scope, /docker/<id>), containerd (cri-containerd-<id>.scope, /kubepods/.../<id>),
+// cri-o (crio-<id>.scope) and podman (libpod-<id>.scope).
+var containerIDRegexp = regexp.MustCompile(`^(?:(?:docker|cri-containerd|crio|libpod)-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+// cgroupResolver maps the cgroup v2 IDs reported by the BPF program to cgroup paths.
+type cgroupResolver struct {
+	logger log.Logger
+	root   string
+
+	mtx      *sync.Mutex
+	paths    map[uint64]string
+	lastScan time.Time
+}
+
+func newCgroupResolver(logger log.Logger) *cgroupResolver {
+	root := cgroupRoot
+	if _, err := os.Stat(cgroupHybridRoot); err == nil {
+		root = cgroupHybridRoot
+	}
+	return &cgroupResolver{
+		logger: logger,
+		root:   root,
+		mtx:    &sync.Mutex{},
+		paths:  map[uint64]string{},
+	}
+}
+
+// path returns the path of the cgroup with the given ID, relative to the cgroup v2 mount point.
+func (r *cgroupResolver) path(id uint64) (string, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if path, ok := r.paths[id]; ok {
+		return path, true
+	}
+	if time.Since(r.lastScan) < cgroupRescanInterval {
+		return "", false
+	}
+
+	if err := r.scan(); err != nil {
+		level.Debug(r.logger).Log("msg", "failed to scan cgroup hierarchy", "err", err)
+	}
+	path, ok := r.paths[id]
+	return path, ok
+}
+
+// scan walks the cgroup v2 hierarchy and records the ID of every cgroup directory.
+func (r *cgroupResolver) scan() error {
+	r.lastScan = time.Now()
+
+	paths := map[uint64]string{}
+	err := filepath.WalkDir(r.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Cgroups come and go, skip whatever disappeared in the meantime.
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(r.root, path)
+		if err != nil {
+			return nil
+		}
+		if rel == "." {
+			rel = ""
+		}
+		paths[st.Ino] = "/" + rel
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk %s: %w", r.root, err)
+	}
+	r.paths = paths
+	return nil
+}
+
+// CgroupID returns the ID of the given cgroup v2 directory, which is what bpf_get_current_cgroup_id reports.
+func CgroupID(path string) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, fmt.Errorf("stat cgroup %s: %w", path, err)
+	}
+	return st.Ino, nil
+}
+
+// procCgroupPath returns the cgroup path of the given process as listed in /proc/<pid>/cgroup.
+// The unified (v2) hierarchy is preferred, otherwise the systemd or cpu controller hierarchy of cgroup v1 is used.
+func procCgroupPath(pid PID) (string, error) {
+	f, err := os.Open(filepath.Join("/proc", fmt.Sprintf("%d", pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	path, err := parseCgroupPath(f)
+	if err != nil {
+		return "", fmt.Errorf("pid %d: %w", pid, err)
+	}
+	return path, nil
+}
+
+// parseCgroupPath returns the cgroup path listed in the given /proc/<pid>/cgroup file.
+func parseCgroupPath(r io.Reader) (string, error) {
+	var v1Path string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Each line looks like hierarchy-ID:controller-list:cgroup-path.
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			if parts[2] != "/" {
+				return parts[2], nil
+			}
+		case parts[1] == "name=systemd":
+			v1Path = parts[2]
+		case v1Path == "" && strings.Contains(","+parts[1]+",", ",cpu,"):
+			v1Path = parts[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if v1Path == "" {
+		return "", errors.New("no cgroup path found")
+	}
+	return v1Path, nil
+}
+
+// containerID extracts the container ID from the given cgroup path, if it belongs to a container.
+func containerID(cgroupPath string) (string, bool) {
+	matches := containerIDRegexp.FindStringSubmatch(filepath.Base(cgroupPath))
+	if matches == nil {
+		return "", false
+	}
+	return matches[1], true
+}
+
+// cgroupLabels returns the cgroup and container labels of the given process.
+func (p *Profiler) cgroupLabels(pid PID, cgroupID uint64) map[string]string {
+	labels := map[string]string{}
+
+	path, ok := p.cgroupResolver.path(cgroupID)
+	if !ok || path == "/" {
+		// Either the host is on cgroup v1 or the cgroup is already gone.
+		var err error
+		path, err = procCgroupPath(pid)
+		if err != nil {
+			level.Debug(p.logger).Log("msg", "failed to find cgroup of process", "pid", pid, "err", err)
+			return labels
+		}
+	}
+
+	labels["cgroup"] = path
+	if id, ok := containerID(path); ok {
+		labels["container_id"] = id
+	}
+	return labels
+}
@@ -0,0 +1,77 @@
+package profiler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContainerID(t *testing.T) {
+	const id = "14c2529eb4498c5d1ffd6915d05bf58a91bdda796af59f41d480d11c099d0479"
+
+	for _, tc := range []struct {
+		cgroupPath string
+		want       string
+	}{
+		// containerd with the systemd and cgroupfs cgroup drivers.
+		{cgroupPath: "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod5f2c.slice/cri-containerd-" + id + ".scope", want: id},
+		{cgroupPath: "/kubepods/besteffort/pod5f2c/" + id, want: id},
+		// cri-o, docker and podman.
+		{cgroupPath: "/kubepods.slice/kubepods-pod5f2c.slice/crio-" + id + ".scope", want: id},
+		{cgroupPath: "/system.slice/docker-" + id + ".scope", want: id},
+		{cgroupPath: "/docker/" + id, want: id},
+		{cgroupPath: "/machine.slice/libpod-" + id + ".scope", want: id},
+		// Monitor processes of the runtimes aren't containers.
+		{cgroupPath: "/kubepods.slice/kubepods-pod5f2c.slice/crio-conmon-" + id + ".scope"},
+		{cgroupPath: "/machine.slice/libpod-conmon-" + id + ".scope"},
+		// Pod slices, services and truncated or uppercase IDs aren't either.
+		{cgroupPath: "/kubepods.slice/kubepods-pod5f2c.slice"},
+		{cgroupPath: "/system.slice/docker.service"},
+		{cgroupPath: "/user.slice/user-1000.slice/session-2.scope"},
+		{cgroupPath: "/system.slice/docker-" + id[1:] + ".scope"},
+		{cgroupPath: "/docker/" + strings.ToUpper(id)},
+		{cgroupPath: "/"},
+	} {
+		got, ok := containerID(tc.cgroupPath)
+		if ok != (tc.want != "") || got != tc.want {
+			t.Errorf("container ID of %s: got %q, %v, want %q", tc.cgroupPath, got, ok, tc.want)
+		}
+	}
+}
+
+func TestParseCgroupPath(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cgroup string
+		want   string
+	}{
+		{
+			name:   "unified",
+			cgroup: "0::/system.slice/docker-abc.scope\n",
+			want:   "/system.slice/docker-abc.scope",
+		},
+		{
+			name:   "hybrid",
+			cgroup: "12:cpu,cpuacct:/docker/abc\n1:name=systemd:/system.slice/docker-abc.scope\n0::/\n",
+			want:   "/system.slice/docker-abc.scope",
+		},
+		{
+			name:   "cpu controller",
+			cgroup: "4:memory:/docker/def\n3:cpu,cpuacct:/docker/abc\n",
+			want:   "/docker/abc",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseCgroupPath(strings.NewReader(tc.cgroup))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := parseCgroupPath(strings.NewReader("0::/\n")); err == nil {
+		t.Error("got no error for a process in the root cgroup")
+	}
+}
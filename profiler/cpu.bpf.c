@@ -3,15 +3,79 @@
 // by the CGO compiler
 
 #include "vmlinux.h"
+#if defined(__TARGET_ARCH_arm64)
+#include "vmlinux_arm64.h"
+#endif
 #include <bpf_helpers.h>
+#include <bpf_tracing.h>
+#include <bpf_core_read.h>
 
 #define KBUILD_MODNAME "tiny-profiler"
 volatile const char bpf_metadata_name[] SEC(".rodata") = "tiny-profiler";
 
 // Max amount of different stack trace addresses to buffer in the Map
 #define MAX_STACK_ADDRESSES 1024
-// Max depth of each stack trace to track
+// Max depth of each stack trace to track, the depth in use is set at load time
 #define MAX_STACK_DEPTH 127
+// Max amount of entries in each of the target filter maps
+#define MAX_FILTER_ENTRIES 1024
+// Length of the task command name, same as in the kernel
+#define TASK_COMM_LEN 16
+// Max amount of tasks that can be blocked at the same time
+#define MAX_OFFCPU_TASKS 10240
+// Max amount of live allocations tracked
+#define MAX_ALLOCS 65536
+// Max amount of rows in the unwind table of a process
+#define MAX_UNWIND_TABLE_SIZE 100000
+// Max amount of processes with an unwind table
+#define MAX_UNWIND_PROCESSES 16
+// Max iterations of the binary search in an unwind table, 2^17 > 100000
+#define MAX_BINARY_SEARCH_DEPTH 17
+
+// How to compute the Canonical Frame Address of a row of an unwind table
+#define CFA_TYPE_END 0
+#define CFA_TYPE_RSP 1
+#define CFA_TYPE_RBP 2
+#define CFA_TYPE_UNSUPPORTED 3
+// Where the rbp of the caller is saved
+#define RBP_TYPE_UNCHANGED 0
+#define RBP_TYPE_OFFSET 1
+
+// Task states, same as in the kernel
+#define TASK_INTERRUPTIBLE 0x0001
+#define TASK_UNINTERRUPTIBLE 0x0002
+
+// How CPU samples reach the profiler
+#define SAMPLE_OUTPUT_MAPS 0
+#define SAMPLE_OUTPUT_RINGBUF 1
+#define SAMPLE_OUTPUT_PERFBUF 2
+// Size of the ring buffer, the profiler shrinks it when it isn't used
+#define SAMPLES_RINGBUF_SIZE (4 * 1024 * 1024)
+
+// Statistics kept in the stats map, by index
+// Samples dropped because their counts map is full
+#define STAT_COUNTS_FULL 0
+// Stacks dropped because their stack traces map is full
+#define STAT_STACK_TRACES_FULL 1
+// Stacks dropped because another stack with the same hash is stored
+#define STAT_STACK_COLLISIONS 2
+// CPU samples of tasks the target filter excludes
+#define STAT_FILTERED 3
+// Allocations that returned after the window they started in, whose stacks
+// the profiler already read and cleaned
+#define STAT_ALLOC_STALE 4
+#define STAT_COUNT 5
+
+// Depth of the walked stacks, rewritten by the profiler before loading. The
+// value size of the stack_traces maps is set to match it.
+volatile const __u32 max_stack_depth SEC(".rodata") = MAX_STACK_DEPTH;
+// Where CPU samples go, rewritten by the profiler before loading. Samples are
+// either counted in the counts maps, or streamed with their raw stacks.
+volatile const __u32 sample_output SEC(".rodata") = SAMPLE_OUTPUT_MAPS;
+// Whether user stacks are walked using unwind tables, rewritten by the
+// profiler before loading. The kernels without the helpers it needs never get
+// to verify the walker then.
+volatile const __u32 dwarf_unwinding SEC(".rodata") = 0;
 
 /*================================ eBPF MAPS =================================*/
 
@@ -32,18 +96,187 @@ typedef __u64 stack_trace_type[MAX_STACK_DEPTH];
 #define BPF_HASH(_name, _key_type, _value_type)                                \
   BPF_MAP(_name, BPF_MAP_TYPE_HASH, _key_type, _value_type, 10240);
 
+#define BPF_ARRAY(_name, _value_type, _max_entries)                            \
+  BPF_MAP(_name, BPF_MAP_TYPE_ARRAY, u32, _value_type, _max_entries);
+
 /*============================= INTERNAL STRUCTS ============================*/
 
 typedef struct stack_count_key {
   u32 pid;
+  u32 tid;
   int user_stack_id;
   int kernel_stack_id;
+  u64 cgroup_id;
+  char comm[TASK_COMM_LEN];
+  // Non-zero when user_stack_id refers to the dwarf_stack_traces maps.
+  u32 user_stack_dwarf;
+  // Non-zero when the task has no user space, so no user stack.
+  u32 kernel_thread;
+  // Generation of the maps the stacks are stored in, it tells apart the keys
+  // of different profiling windows.
+  u32 generation;
+  // Non-zero when both stack IDs refer to the offcpu_stack_traces maps.
+  u32 offcpu_stacks;
 } stack_count_key_t;
 
+// A streamed CPU sample. The stack IDs of the key hold the size in bytes of
+// the walked stacks, or the negative error of walking them.
+typedef struct stack_sample {
+  stack_count_key_t key;
+  u64 user_stack[MAX_STACK_DEPTH];
+  u64 kernel_stack[MAX_STACK_DEPTH];
+} stack_sample_t;
+
+typedef struct generation_config {
+  // Generation of the maps samples are recorded in, it counts up with every
+  // profiling window and its lowest bit selects the maps.
+  u32 generation;
+} generation_config_t;
+
+typedef struct filter_config {
+  // Non-zero when sampling is restricted to the tasks in the filter maps.
+  u32 enabled;
+} filter_config_t;
+
+typedef struct offcpu_start {
+  // Time the task got blocked at.
+  u64 ts;
+  // The task and the raw stacks it blocked in. The stacks are stored in the
+  // maps of the generation the task wakes up in.
+  stack_sample_t sample;
+} offcpu_start_t;
+
+typedef struct alloc_info {
+  u64 size;
+  stack_count_key_t key;
+} alloc_info_t;
+
+typedef struct alloc_pending {
+  alloc_info_t info;
+  // Block that realloc frees once it succeeds, 0 for the other allocators.
+  u64 realloc_addr;
+} alloc_pending_t;
+
+typedef struct alloc_key {
+  u64 addr;
+  u32 pid;
+  u32 pad;
+} alloc_key_t;
+
+typedef struct alloc_value {
+  u64 alloc_objects;
+  u64 alloc_bytes;
+  // Change of the live allocations of the stack within the window, which
+  // include the tracked allocations of previous windows.
+  s64 inuse_objects;
+  s64 inuse_bytes;
+} alloc_value_t;
+
+typedef struct unwind_row {
+  u64 pc;
+  u8 cfa_type;
+  u8 rbp_type;
+  s16 cfa_offset;
+  s16 rbp_offset;
+  u16 padding;
+} unwind_row_t;
+
+// Rows are sorted by pc, a row applies up to the pc of the next one.
+typedef struct unwind_table {
+  u64 len;
+  unwind_row_t rows[MAX_UNWIND_TABLE_SIZE];
+} unwind_table_t;
+
+typedef struct comm_prefix_key {
+  u32 prefixlen;
+  char comm[TASK_COMM_LEN];
+} comm_prefix_key_t;
+
 /*================================ MAPS =====================================*/
 
-BPF_HASH(counts, stack_count_key_t, u64);
-BPF_STACK_TRACE(stack_traces, MAX_STACK_ADDRESSES);
+// The maps samples are recorded in come in two generations, _0 and _1. The
+// profiler reads and cleans one generation while the other one is written.
+BPF_ARRAY(generation_config, generation_config_t, 1);
+#define GENERATION_MAP(_name, _generation)                                     \
+  (((_generation) & 1) ? (void *)&_name##_1 : (void *)&_name##_0)
+
+BPF_HASH(counts_0, stack_count_key_t, u64);
+BPF_HASH(counts_1, stack_count_key_t, u64);
+BPF_STACK_TRACE(stack_traces_0, MAX_STACK_ADDRESSES);
+BPF_STACK_TRACE(stack_traces_1, MAX_STACK_ADDRESSES);
+
+// Tasks exiting while blocked never wake up, LRU eviction keeps their entries
+// from filling the map.
+BPF_MAP(offcpu_start, BPF_MAP_TYPE_LRU_HASH, u32, offcpu_start_t,
+        MAX_OFFCPU_TASKS);
+BPF_HASH(offcpu_counts_0, stack_count_key_t, u64);
+BPF_HASH(offcpu_counts_1, stack_count_key_t, u64);
+// Stacks of the tasks that woke up, by hash of the addresses.
+BPF_MAP(offcpu_stack_traces_0, BPF_MAP_TYPE_HASH, u32, stack_trace_type,
+        MAX_STACK_ADDRESSES);
+BPF_MAP(offcpu_stack_traces_1, BPF_MAP_TYPE_HASH, u32, stack_trace_type,
+        MAX_STACK_ADDRESSES);
+// Blocked tasks don't fit on the BPF stack, they are described in here.
+BPF_MAP(offcpu_scratch, BPF_MAP_TYPE_PERCPU_ARRAY, u32, offcpu_start_t, 1);
+
+// Allocations between the entry and the return of the allocator, by thread.
+BPF_MAP(alloc_pending, BPF_MAP_TYPE_LRU_HASH, u32, alloc_pending_t, 10240);
+// Live allocations, whichever window they were allocated in. They keep the
+// key they were counted with, frees are counted with it.
+BPF_MAP(allocs, BPF_MAP_TYPE_HASH, alloc_key_t, alloc_info_t, MAX_ALLOCS);
+BPF_HASH(alloc_counts_0, stack_count_key_t, alloc_value_t);
+BPF_HASH(alloc_counts_1, stack_count_key_t, alloc_value_t);
+BPF_HASH(go_alloc_counts_0, stack_count_key_t, alloc_value_t);
+BPF_HASH(go_alloc_counts_1, stack_count_key_t, alloc_value_t);
+
+// Counted per CPU, so that concurrent samples don't contend.
+BPF_MAP(stats, BPF_MAP_TYPE_PERCPU_ARRAY, u32, u64, STAT_COUNT);
+
+BPF_ARRAY(filter_config, filter_config_t, 1);
+BPF_MAP(filter_pids, BPF_MAP_TYPE_HASH, u32, u8, MAX_FILTER_ENTRIES);
+BPF_MAP(filter_cgroups, BPF_MAP_TYPE_HASH, u64, u8, MAX_FILTER_ENTRIES);
+
+// Unwind tables of the processes built without frame pointers, by PID. The
+// tables are big, so only the used entries are allocated.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_UNWIND_PROCESSES);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __type(key, u32);
+  __type(value, unwind_table_t);
+} unwind_tables SEC(".maps");
+
+// User stacks walked using the unwind tables, by hash of the addresses.
+BPF_MAP(dwarf_stack_traces_0, BPF_MAP_TYPE_HASH, u32, stack_trace_type,
+        MAX_STACK_ADDRESSES);
+BPF_MAP(dwarf_stack_traces_1, BPF_MAP_TYPE_HASH, u32, stack_trace_type,
+        MAX_STACK_ADDRESSES);
+// Stacks don't fit on the BPF stack, they are walked in here.
+BPF_MAP(dwarf_stack_scratch, BPF_MAP_TYPE_PERCPU_ARRAY, u32, stack_trace_type,
+        1);
+
+// Streamed CPU samples, the perf buffer is used on kernels without ring
+// buffers.
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, SAMPLES_RINGBUF_SIZE);
+} samples_ringbuf SEC(".maps");
+struct {
+  __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+  __uint(key_size, sizeof(u32));
+  __uint(value_size, sizeof(u32));
+} samples_perfbuf SEC(".maps");
+// Samples don't fit on the BPF stack, they are built in here.
+BPF_MAP(sample_scratch, BPF_MAP_TYPE_PERCPU_ARRAY, u32, stack_sample_t, 1);
+
+// LPM tries can't be preallocated, so this can't use the BPF_MAP macro.
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, MAX_FILTER_ENTRIES);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __type(key, comm_prefix_key_t);
+  __type(value, u8);
+} filter_comms SEC(".maps");
 
 /*=========================== HELPER FUNCTIONS ==============================*/
 
@@ -63,42 +296,605 @@ bpf_map_lookup_or_try_init(void *map, const void *key, const void *init) {
   return bpf_map_lookup_elem(map, key);
 }
 
-/*================================= HOOKS ==================================*/
+// current_generation returns the generation of the maps to record samples in.
+static __always_inline u32 current_generation() {
+  u32 zero = 0;
+  generation_config_t *config = bpf_map_lookup_elem(&generation_config, &zero);
+  if (!config)
+    return 0;
+  return config->generation;
+}
 
-SEC("perf_event")
-int profile_cpu(struct bpf_perf_event_data *ctx) {
+// count_stat increments the given statistic on the current CPU.
+static __always_inline void count_stat(u32 stat) {
+  u64 *value = bpf_map_lookup_elem(&stats, &stat);
+  if (value)
+    *value += 1;
+}
+
+// count_stack_id_error accounts for the stacks bpf_get_stackid couldn't
+// store.
+static __always_inline void count_stack_id_error(int stack_id) {
+  if (stack_id == -12) // 12 == ENOMEM
+    count_stat(STAT_STACK_TRACES_FULL);
+  else if (stack_id == -17) // 17 == EEXIST
+    count_stat(STAT_STACK_COLLISIONS);
+}
+
+// should_sample reports whether the task described by the key passes the
+// target filter.
+static __always_inline bool should_sample(stack_count_key_t *key) {
+  u32 zero = 0;
+  filter_config_t *config = bpf_map_lookup_elem(&filter_config, &zero);
+  if (!config || !config->enabled)
+    return true;
+
+  if (bpf_map_lookup_elem(&filter_pids, &key->pid))
+    return true;
+
+  if (bpf_map_lookup_elem(&filter_cgroups, &key->cgroup_id))
+    return true;
+
+  comm_prefix_key_t comm_key = {.prefixlen = TASK_COMM_LEN * 8};
+  __builtin_memcpy(comm_key.comm, key->comm, TASK_COMM_LEN);
+  if (bpf_map_lookup_elem(&filter_comms, &comm_key))
+    return true;
+
+  return false;
+}
+
+// store_stack stores the given stack in the given map of stacks by hash. Like
+// bpf_get_stackid, it returns the hash, which serves as stack ID, or the
+// negative error of storing the stack.
+static __always_inline int store_stack(void *stack_traces,
+                                       stack_trace_type *stack) {
+  u32 hash = 2166136261;
+  for (int i = 0; i < MAX_STACK_DEPTH; i++) {
+    hash = (hash ^ (u32)(*stack)[i]) * 16777619;
+    hash = (hash ^ (u32)((*stack)[i] >> 32)) * 16777619;
+  }
+
+  // Negative stack IDs are errors and stack ID 0 means that walking failed.
+  hash &= 0x7fffffff;
+  if (hash == 0)
+    hash = 1;
+
+  // Another stack may have the same hash, it must not be overwritten.
+  long err = bpf_map_update_elem(stack_traces, &hash, stack, BPF_NOEXIST);
+  if (err == -17) { // 17 == EEXIST
+    stack_trace_type *stored = bpf_map_lookup_elem(stack_traces, &hash);
+    if (!stored)
+      return -17;
+    for (int i = 0; i < MAX_STACK_DEPTH; i++) {
+      if ((*stored)[i] != (*stack)[i]) {
+        count_stack_id_error(-17);
+        return -17;
+      }
+    }
+  } else if (err) {
+    count_stack_id_error(-12); // 12 == ENOMEM
+    return -12;
+  }
+
+  return hash;
+}
+
+// The unwind rows describe the registers of x86_64, other architectures fall
+// back to frame pointers.
+#if defined(__TARGET_ARCH_x86)
+
+// find_unwind_row returns the last row of the table whose pc is not above the
+// given one.
+static __always_inline unwind_row_t *find_unwind_row(unwind_table_t *table,
+                                                     u64 pc) {
+  u64 left = 0;
+  u64 right = table->len;
+  u64 found = MAX_UNWIND_TABLE_SIZE;
+
+  for (int i = 0; i < MAX_BINARY_SEARCH_DEPTH; i++) {
+    if (left >= right)
+      break;
+
+    u64 mid = left + (right - left) / 2;
+    if (mid >= MAX_UNWIND_TABLE_SIZE)
+      return 0;
+
+    if (table->rows[mid].pc <= pc) {
+      found = mid;
+      left = mid + 1;
+    } else {
+      right = mid;
+    }
+  }
+
+  if (found >= MAX_UNWIND_TABLE_SIZE)
+    return 0;
+  return &table->rows[found];
+}
+
+// dwarf_walk_user_stack walks the user stack of the current task using the
+// given unwind table into dwarf_stack_scratch. It returns the walked stack,
+// or NULL when not even the first frame could be unwound.
+static __always_inline stack_trace_type *
+dwarf_walk_user_stack(unwind_table_t *table) {
+  u32 zero = 0;
+  stack_trace_type *stack = bpf_map_lookup_elem(&dwarf_stack_scratch, &zero);
+  if (!stack)
+    return NULL;
+
+  // The user registers are saved whenever the task enters the kernel, no
+  // matter which program runs.
+  struct task_struct *task = bpf_get_current_task_btf();
+  struct pt_regs *regs = (struct pt_regs *)bpf_task_pt_regs(task);
+  if (!regs)
+    return NULL;
+
+  u64 ip = PT_REGS_IP_CORE(regs);
+  u64 sp = PT_REGS_SP_CORE(regs);
+  u64 bp = PT_REGS_FP_CORE(regs);
+  int depth = 0;
+
+  for (int i = 0; i < MAX_STACK_DEPTH; i++) {
+    (*stack)[i] = 0;
+  }
+
+  for (int i = 0; i < MAX_STACK_DEPTH; i++) {
+    if (i >= max_stack_depth)
+      break;
+
+    (*stack)[i] = ip;
+    depth++;
+
+    // Return addresses point after the call, which may be the last
+    // instruction of the caller.
+    unwind_row_t *row = find_unwind_row(table, i == 0 ? ip : ip - 1);
+    if (!row)
+      break;
+
+    u64 cfa;
+    if (row->cfa_type == CFA_TYPE_RSP)
+      cfa = sp + row->cfa_offset;
+    else if (row->cfa_type == CFA_TYPE_RBP)
+      cfa = bp + row->cfa_offset;
+    else
+      break;
+
+    if (row->rbp_type == RBP_TYPE_OFFSET &&
+        bpf_probe_read_user(&bp, sizeof(bp), (void *)(cfa + row->rbp_offset)))
+      break;
+
+    // The return address is always right below the CFA on x86_64.
+    u64 ra;
+    if (bpf_probe_read_user(&ra, sizeof(ra), (void *)(cfa - 8)))
+      break;
+    if (ra == 0)
+      break;
+
+    ip = ra;
+    sp = cfa;
+  }
+
+  if (depth < 2)
+    return NULL;
+  return stack;
+}
+
+// dwarf_user_stack_id walks the user stack of the current task using the
+// given unwind table and stores it in dwarf_stack_traces of the given
+// generation. It returns false when not even the first frame could be unwound.
+static __always_inline bool dwarf_user_stack_id(unwind_table_t *table,
+                                                u32 generation, int *stack_id) {
+  stack_trace_type *stack = dwarf_walk_user_stack(table);
+  if (!stack)
+    return false;
+
+  int id = store_stack(GENERATION_MAP(dwarf_stack_traces, generation), stack);
+  if (id < 0)
+    return false;
+
+  *stack_id = id;
+  return true;
+}
+
+#else
+
+static __always_inline stack_trace_type *
+dwarf_walk_user_stack(unwind_table_t *table) {
+  return NULL;
+}
+
+static __always_inline bool dwarf_user_stack_id(unwind_table_t *table,
+                                                u32 generation, int *stack_id) {
+  return false;
+}
+
+#endif
+
+// fill_task describes the current task in the given key, without its stacks.
+// It returns false when the task must not be sampled. Only CPU samples of the
+// tasks the target filter excludes are counted as skipped, the other programs
+// see filtered tasks on every event.
+static __always_inline bool fill_task(stack_count_key_t *key,
+                                      bool cpu_sample) {
   u64 id = bpf_get_current_pid_tgid();
   u32 tgid = id >> 32;
   u32 pid = id;
 
   if (pid == 0)
-    return 0;
+    return false;
+
+  key->pid = tgid;
+  key->tid = pid;
+  key->user_stack_id = 0;
+  key->kernel_stack_id = 0;
+  key->cgroup_id = bpf_get_current_cgroup_id();
+  key->user_stack_dwarf = 0;
+  key->kernel_thread = 0;
+  key->generation = 0;
+  key->offcpu_stacks = 0;
+  bpf_get_current_comm(&key->comm, sizeof(key->comm));
 
-  // create map key
-  stack_count_key_t key = {
-      .pid = tgid,
-      .user_stack_id = 0,
-      .kernel_stack_id = 0,
-  };
+  if (!should_sample(key)) {
+    if (cpu_sample)
+      count_stat(STAT_FILTERED);
+    return false;
+  }
+
+  // Kernel threads have no user stack to walk.
+  struct task_struct *task = (void *)bpf_get_current_task();
+  void *mm = NULL;
+  bpf_probe_read_kernel(&mm, sizeof(mm), &task->mm);
+  if (!mm)
+    key->kernel_thread = 1;
+
+  return true;
+}
 
-  // get user stack id
-  int stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
-  if (stack_id >= 0)
-    key.user_stack_id = stack_id;
+// fill_stack_count_key describes the current task and its stacks in the
+// given key. It returns false when the task must not be sampled.
+static __always_inline bool fill_stack_count_key(void *ctx,
+                                                 stack_count_key_t *key,
+                                                 bool kernel_stack,
+                                                 bool cpu_sample) {
+  if (!fill_task(key, cpu_sample))
+    return false;
+
+  // The stacks are stored in the maps of the current generation, the samples
+  // are recorded in the same generation.
+  key->generation = current_generation();
+  void *stack_traces = GENERATION_MAP(stack_traces, key->generation);
+
+  // Stack IDs keep the negative error of bpf_get_stackid when walking fails,
+  // the profiler accounts for the failures.
+  if (!key->kernel_thread) {
+    // Binaries without frame pointers are unwound using their unwind tables.
+    unwind_table_t *table = NULL;
+    if (dwarf_unwinding)
+      table = bpf_map_lookup_elem(&unwind_tables, &key->pid);
+    if (table &&
+        dwarf_user_stack_id(table, key->generation, &key->user_stack_id)) {
+      key->user_stack_dwarf = 1;
+    } else {
+      // get user stack id
+      key->user_stack_id =
+          bpf_get_stackid(ctx, stack_traces, BPF_F_USER_STACK);
+      count_stack_id_error(key->user_stack_id);
+    }
+  }
+
+  if (!kernel_stack)
+    return true;
 
   // get kernel stack id
-  int kernel_stack_id = bpf_get_stackid(ctx, &stack_traces, 0);
-  if (kernel_stack_id >= 0)
-    key.kernel_stack_id = kernel_stack_id;
+  key->kernel_stack_id = bpf_get_stackid(ctx, stack_traces, 0);
+  count_stack_id_error(key->kernel_stack_id);
+
+  return true;
+}
+
+// fill_stack_sample describes the current task and its raw stacks in the
+// given sample. Frames past the walked ones are zero. It returns false when the
+// task must not be sampled.
+static __always_inline bool fill_stack_sample(void *ctx,
+                                              stack_sample_t *sample,
+                                              bool cpu_sample) {
+  __builtin_memset(&sample->key, 0, sizeof(sample->key));
+  if (!fill_task(&sample->key, cpu_sample))
+    return false;
+
+  for (int i = 0; i < MAX_STACK_DEPTH; i++) {
+    sample->user_stack[i] = 0;
+    sample->kernel_stack[i] = 0;
+  }
+
+  u32 size = max_stack_depth * sizeof(u64);
+  if (size > sizeof(sample->user_stack))
+    size = sizeof(sample->user_stack);
+
+  if (!sample->key.kernel_thread) {
+    // Binaries without frame pointers are unwound using their unwind tables.
+    unwind_table_t *table = NULL;
+    if (dwarf_unwinding)
+      table = bpf_map_lookup_elem(&unwind_tables, &sample->key.pid);
+    stack_trace_type *stack = NULL;
+    if (table)
+      stack = dwarf_walk_user_stack(table);
+    if (stack) {
+      __builtin_memcpy(sample->user_stack, stack, sizeof(sample->user_stack));
+      sample->key.user_stack_id = size;
+      sample->key.user_stack_dwarf = 1;
+    } else {
+      sample->key.user_stack_id =
+          bpf_get_stack(ctx, sample->user_stack, size, BPF_F_USER_STACK);
+    }
+  }
+  sample->key.kernel_stack_id =
+      bpf_get_stack(ctx, sample->kernel_stack, size, 0);
+
+  return true;
+}
+
+// stream_sample sends the current task and its raw stacks to the profiler,
+// which aggregates them.
+static __always_inline void stream_sample(void *ctx) {
+  u32 zero = 0;
+  stack_sample_t *sample = bpf_map_lookup_elem(&sample_scratch, &zero);
+  if (!sample)
+    return;
+
+  if (!fill_stack_sample(ctx, sample, true))
+    return;
+
+  if (sample_output == SAMPLE_OUTPUT_RINGBUF)
+    bpf_ringbuf_output(&samples_ringbuf, sample, sizeof(*sample), 0);
+  else
+    bpf_perf_event_output(ctx, &samples_perfbuf, BPF_F_CURRENT_CPU, sample,
+                          sizeof(*sample));
+}
+
+/*================================= HOOKS ==================================*/
+
+SEC("perf_event")
+int profile_cpu(struct bpf_perf_event_data *ctx) {
+  if (sample_output != SAMPLE_OUTPUT_MAPS) {
+    stream_sample(ctx);
+    return 0;
+  }
+
+  stack_count_key_t key = {};
+  if (!fill_stack_count_key(ctx, &key, true, true))
+    return 0;
 
   u64 zero = 0;
   u64 *count;
-  count = bpf_map_lookup_or_try_init(&counts, &key, &zero);
-  if (!count)
+  count = bpf_map_lookup_or_try_init(GENERATION_MAP(counts, key.generation),
+                                     &key, &zero);
+  if (!count) {
+    count_stat(STAT_COUNTS_FULL);
     return 0;
+  }
 
   __sync_fetch_and_add(count, 1);
   return 0;
 }
 
+// Runs in the context of the task being switched out, so its stacks are the
+// ones it blocks in.
+SEC("tracepoint/sched/sched_switch")
+int offcpu_sched_switch(struct trace_event_raw_sched_switch *ctx) {
+  // Preempted tasks are still runnable, only blocked ones are off-CPU.
+  if (!(ctx->prev_state & (TASK_INTERRUPTIBLE | TASK_UNINTERRUPTIBLE)))
+    return 0;
+
+  u32 zero = 0;
+  offcpu_start_t *start = bpf_map_lookup_elem(&offcpu_scratch, &zero);
+  if (!start)
+    return 0;
+
+  // The stacks are kept raw, the generation of the maps may switch before the
+  // task wakes up.
+  if (!fill_stack_sample(ctx, &start->sample, false))
+    return 0;
+  start->ts = bpf_ktime_get_ns();
+
+  u32 tid = start->sample.key.tid;
+  bpf_map_update_elem(&offcpu_start, &tid, start, BPF_ANY);
+  return 0;
+}
+
+SEC("tracepoint/sched/sched_wakeup")
+int offcpu_sched_wakeup(struct trace_event_raw_sched_wakeup_template *ctx) {
+  u32 tid = ctx->pid;
+  offcpu_start_t *start = bpf_map_lookup_elem(&offcpu_start, &tid);
+  if (!start)
+    return 0;
+
+  u64 delta = bpf_ktime_get_ns() - start->ts;
+
+  // However long the task was blocked, its time and stacks go to the
+  // generation it wakes up in. The stack IDs hold the sizes of the stacks
+  // until they are stored, or the errors of walking them.
+  stack_count_key_t key = start->sample.key;
+  key.generation = current_generation();
+  key.offcpu_stacks = 1;
+  void *stack_traces = GENERATION_MAP(offcpu_stack_traces, key.generation);
+  if (key.user_stack_id > 0)
+    key.user_stack_id = store_stack(
+        stack_traces, (stack_trace_type *)start->sample.user_stack);
+  if (key.kernel_stack_id > 0)
+    key.kernel_stack_id = store_stack(
+        stack_traces, (stack_trace_type *)start->sample.kernel_stack);
+  bpf_map_delete_elem(&offcpu_start, &tid);
+
+  u64 zero = 0;
+  u64 *total;
+  total = bpf_map_lookup_or_try_init(
+      GENERATION_MAP(offcpu_counts, key.generation), &key, &zero);
+  if (!total) {
+    count_stat(STAT_COUNTS_FULL);
+    return 0;
+  }
+
+  __sync_fetch_and_add(total, delta);
+  return 0;
+}
+
+// record_alloc_enter remembers the size and the stacks of an allocation until
+// the allocator returns its address, along with the block realloc frees.
+static __always_inline int record_alloc_enter(struct pt_regs *ctx, u64 size,
+                                              u64 realloc_addr) {
+  alloc_pending_t pending = {.info = {.size = size},
+                             .realloc_addr = realloc_addr};
+  // The kernel stack of a uprobe is the breakpoint handler, skip it.
+  if (!fill_stack_count_key(ctx, &pending.info.key, false, false))
+    return 0;
+
+  u32 tid = pending.info.key.tid;
+  bpf_map_update_elem(&alloc_pending, &tid, &pending, BPF_ANY);
+  return 0;
+}
+
+// record_free forgets the given allocation if it is live. The free is counted
+// in the current generation with the key of the allocation, which the profiler
+// still knows the stacks of when it was made in a previous window.
+static __always_inline void record_free(u64 addr) {
+  if (!addr)
+    return;
+
+  alloc_key_t alloc_key = {.addr = addr,
+                           .pid = bpf_get_current_pid_tgid() >> 32};
+  alloc_info_t *info = bpf_map_lookup_elem(&allocs, &alloc_key);
+  if (!info)
+    return;
+
+  alloc_value_t zero = {};
+  alloc_value_t *value;
+  value = bpf_map_lookup_or_try_init(
+      GENERATION_MAP(alloc_counts, current_generation()), &info->key, &zero);
+  if (value) {
+    __sync_fetch_and_add(&value->inuse_objects, -1);
+    __sync_fetch_and_add(&value->inuse_bytes, -(s64)info->size);
+  } else {
+    count_stat(STAT_COUNTS_FULL);
+  }
+
+  bpf_map_delete_elem(&allocs, &alloc_key);
+}
+
+SEC("uprobe/malloc")
+int malloc_enter(struct pt_regs *ctx) {
+  return record_alloc_enter(ctx, PT_REGS_PARM1(ctx), 0);
+}
+
+SEC("uprobe/calloc")
+int calloc_enter(struct pt_regs *ctx) {
+  return record_alloc_enter(ctx, PT_REGS_PARM1(ctx) * PT_REGS_PARM2(ctx), 0);
+}
+
+// realloc frees the given block and allocates a new one. The block is only
+// freed when realloc succeeds, it's forgotten when realloc returns.
+SEC("uprobe/realloc")
+int realloc_enter(struct pt_regs *ctx) {
+  return record_alloc_enter(ctx, PT_REGS_PARM2(ctx), PT_REGS_PARM1(ctx));
+}
+
+// Attached to the returns of malloc, calloc and realloc.
+SEC("uretprobe/alloc")
+int alloc_exit(struct pt_regs *ctx) {
+  u32 tid = bpf_get_current_pid_tgid();
+  alloc_pending_t *pending = bpf_map_lookup_elem(&alloc_pending, &tid);
+  if (!pending)
+    return 0;
+
+  alloc_info_t info = pending->info;
+  u64 realloc_addr = pending->realloc_addr;
+  bpf_map_delete_elem(&alloc_pending, &tid);
+
+  u64 addr = PT_REGS_RC(ctx);
+  if (!addr)
+    return 0;
+
+  record_free(realloc_addr);
+
+  // The stacks of the key were stored in the maps of the generation the
+  // allocation started in, which the profiler may have read and cleaned.
+  if (info.key.generation != current_generation()) {
+    count_stat(STAT_ALLOC_STALE);
+    return 0;
+  }
+
+  alloc_value_t zero = {};
+  alloc_value_t *value;
+  value = bpf_map_lookup_or_try_init(
+      GENERATION_MAP(alloc_counts, info.key.generation), &info.key, &zero);
+  if (!value) {
+    count_stat(STAT_COUNTS_FULL);
+    return 0;
+  }
+
+  __sync_fetch_and_add(&value->alloc_objects, 1);
+  __sync_fetch_and_add(&value->alloc_bytes, info.size);
+
+  // An address that is handed out again was freed without the free being
+  // seen, e.g. by an allocator function that isn't probed.
+  record_free(addr);
+
+  // Once too many allocations are live, their frees can't be matched anymore.
+  alloc_key_t alloc_key = {.addr = addr, .pid = info.key.pid};
+  if (bpf_map_update_elem(&allocs, &alloc_key, &info, BPF_ANY))
+    return 0;
+
+  __sync_fetch_and_add(&value->inuse_objects, 1);
+  __sync_fetch_and_add(&value->inuse_bytes, info.size);
+  return 0;
+}
+
+SEC("uprobe/free")
+int free_enter(struct pt_regs *ctx) {
+  record_free(PT_REGS_PARM1(ctx));
+  return 0;
+}
+
+// With the register based calling convention, Go passes the first integer
+// argument in the register that also holds return values (rax, x0).
+#define GO_REGABI_PARM1(x) PT_REGS_RC(x)
+
+static __always_inline int record_go_alloc(struct pt_regs *ctx, u64 size) {
+  stack_count_key_t key = {};
+  if (!fill_stack_count_key(ctx, &key, false, false))
+    return 0;
+
+  alloc_value_t zero = {};
+  alloc_value_t *value;
+  value = bpf_map_lookup_or_try_init(
+      GENERATION_MAP(go_alloc_counts, key.generation), &key, &zero);
+  if (!value) {
+    count_stat(STAT_COUNTS_FULL);
+    return 0;
+  }
+
+  __sync_fetch_and_add(&value->alloc_objects, 1);
+  __sync_fetch_and_add(&value->alloc_bytes, size);
+  return 0;
+}
+
+// Attached to runtime.mallocgc of binaries built with Go 1.17+ (amd64) or
+// Go 1.18+ (arm64).
+SEC("uprobe/mallocgc")
+int go_mallocgc_enter(struct pt_regs *ctx) {
+  return record_go_alloc(ctx, GO_REGABI_PARM1(ctx));
+}
+
+// Attached to runtime.mallocgc of binaries built with older Go versions,
+// which pass arguments on the stack, right above the return address.
+SEC("uprobe/mallocgc_stack")
+int go_mallocgc_stack_enter(struct pt_regs *ctx) {
+  u64 size = 0;
+  if (bpf_probe_read_user(&size, sizeof(size),
+                          (void *)(PT_REGS_SP(ctx) + sizeof(u64))))
+    return 0;
+
+  return record_go_alloc(ctx, size);
+}
+
 char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,186 @@
+package profiler
+
+import (
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// debuginfodRetryInterval is how long build IDs the servers don't know are not asked for again.
+	debuginfodRetryInterval = 10 * time.Minute
+	// debuginfodPendingRetryInterval is how long the local symbols of an object file whose debug info is being
+	// fetched are used before looking for the debug info again, so that a profiling window doesn't look for each location.
+	debuginfodPendingRetryInterval = 5 * time.Second
+	// debuginfodFetchTimeout bounds the fetch of the debug info of a build ID from all the servers.
+	debuginfodFetchTimeout = 5 * time.Minute
+	// debuginfodResponseTimeout bounds connecting to a server and waiting for its response headers.
+	// Debug info files may take minutes to download, the body is only bounded by debuginfodFetchTimeout.
+	debuginfodResponseTimeout = time.Minute
+)
+
+var (
+	errDebugInfoNotFound = errors.New("debug info not found")
+	errDebugInfoPending  = errors.New("debug info is being fetched")
+)
+
+// DebuginfodClient fetches the debug info of stripped object files by build ID from debuginfod servers.
+// Fetches run in the background, so that slow servers don't hold up profiling. Fetched files are cached
+// on disk, in a directory per build ID.
+type DebuginfodClient struct {
+	logger   log.Logger
+	urls     []string
+	cacheDir string
+	client   *http.Client
+
+	mtx *sync.Mutex
+	// notFound records when the servers didn't have the debug info of a build ID.
+	notFound map[string]time.Time
+	// pending holds the build IDs being fetched.
+	pending map[string]struct{}
+	// fetches tracks the fetches in flight.
+	fetches *sync.WaitGroup
+}
+
+// NewDebuginfodClient creates a client that asks the servers at the given URLs in order,
+// e.g. https://debuginfod.elfutils.org, and caches the debug info in the given directory.
+func NewDebuginfodClient(logger log.Logger, urls []string, cacheDir string) *DebuginfodClient {
+	trimmed := make([]string, 0, len(urls))
+	for _, u := range urls {
+		trimmed = append(trimmed, strings.TrimSuffix(u, "/"))
+	}
+	return &DebuginfodClient{
+		logger:   logger,
+		urls:     trimmed,
+		cacheDir: cacheDir,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: debuginfodResponseTimeout,
+			},
+		},
+		mtx:      &sync.Mutex{},
+		notFound: map[string]time.Time{},
+		pending:  map[string]struct{}{},
+		fetches:  &sync.WaitGroup{},
+	}
+}
+
+// DebugInfo returns the path of the debug info file of the given build ID. When it isn't cached yet,
+// it starts fetching it and returns errDebugInfoPending, the file is there once the fetch succeeded.
+func (c *DebuginfodClient) DebugInfo(_ context.Context, buildID string) (string, error) {
+	// Build IDs end up in paths and URLs, they are hex strings.
+	if buildID == "" || strings.Trim(strings.ToLower(buildID), "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid build ID %q", buildID)
+	}
+
+	path := filepath.Join(c.cacheDir, buildID, "debuginfo")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.pending[buildID]; ok {
+		return "", errDebugInfoPending
+	}
+	if at, ok := c.notFound[buildID]; ok && time.Since(at) < debuginfodRetryInterval {
+		return "", errDebugInfoNotFound
+	}
+
+	c.pending[buildID] = struct{}{}
+	c.fetches.Add(1)
+	go func() {
+		defer c.fetches.Done()
+		found := c.fetchAll(buildID, path)
+
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		delete(c.pending, buildID)
+		if found {
+			delete(c.notFound, buildID)
+		} else {
+			c.notFound[buildID] = time.Now()
+		}
+	}()
+	return "", errDebugInfoPending
+}
+
+// fetchAll asks the servers for the debug info of the given build ID in order, until one has it.
+func (c *DebuginfodClient) fetchAll(buildID, path string) bool {
+	// The fetch outlives the profiling window that asked for it.
+	ctx, cancel := context.WithTimeout(context.Background(), debuginfodFetchTimeout)
+	defer cancel()
+
+	for _, u := range c.urls {
+		err := c.fetch(ctx, u, buildID, path)
+		if err == nil {
+			level.Debug(c.logger).Log("msg", "fetched debug info", "buildID", buildID, "url", u)
+			return true
+		}
+		if !errors.Is(err, errDebugInfoNotFound) {
+			level.Debug(c.logger).Log("msg", "failed to fetch debug info", "buildID", buildID, "url", u, "err", err)
+		}
+	}
+	return false
+}
+
+// fetch downloads the debug info of the given build ID from a server to the given path.
+func (c *DebuginfodClient) fetch(ctx context.Context, serverURL, buildID, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/buildid/"+buildID+"/debuginfo", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errDebugInfoNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Download next to the final path, so that a partial download is never picked up.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "debuginfo-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+
+	f, err := elf.Open(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("invalid debug info: %w", err)
+	}
+	f.Close()
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,81 @@
+package profiler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestDebuginfodClient(t *testing.T) {
+	const (
+		knownBuildID   = "0123456789abcdef0123456789abcdef01234567"
+		unknownBuildID = "fedcba9876543210fedcba9876543210fedcba98"
+	)
+	// Any ELF file passes for debug info.
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mtx      sync.Mutex
+		requests = map[string]int{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests[r.URL.Path]++
+		mtx.Unlock()
+		if r.URL.Path != "/buildid/"+knownBuildID+"/debuginfo" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, self)
+	}))
+	defer srv.Close()
+
+	c := NewDebuginfodClient(log.NewNopLogger(), []string{srv.URL + "/"}, t.TempDir())
+	ctx := context.Background()
+
+	for _, buildID := range []string{knownBuildID, unknownBuildID} {
+		if _, err := c.DebugInfo(ctx, buildID); !errors.Is(err, errDebugInfoPending) {
+			t.Fatalf("got %v for %s, want %v", err, buildID, errDebugInfoPending)
+		}
+	}
+	c.fetches.Wait()
+
+	// Both the fetched file and the miss are cached.
+	for i := 0; i < 2; i++ {
+		path, err := c.DebugInfo(ctx, knownBuildID)
+		if err != nil {
+			t.Fatalf("debug info of %s: %v", knownBuildID, err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("debug info of %s: %v", knownBuildID, err)
+		}
+		if _, err := c.DebugInfo(ctx, unknownBuildID); !errors.Is(err, errDebugInfoNotFound) {
+			t.Fatalf("got %v for %s, want %v", err, unknownBuildID, errDebugInfoNotFound)
+		}
+	}
+	c.fetches.Wait()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, buildID := range []string{knownBuildID, unknownBuildID} {
+		if n := requests["/buildid/"+buildID+"/debuginfo"]; n != 1 {
+			t.Errorf("got %d requests for %s, want 1", n, buildID)
+		}
+	}
+}
+
+func TestDebuginfodClientInvalidBuildID(t *testing.T) {
+	c := NewDebuginfodClient(log.NewNopLogger(), []string{"http://localhost:0"}, t.TempDir())
+	if _, err := c.DebugInfo(context.Background(), "../../etc/passwd"); err == nil {
+		t.Fatal("got no error for an invalid build ID")
+	}
+}
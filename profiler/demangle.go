@@ -0,0 +1,53 @@
+package profiler
+
+import (
+	"fmt"
+
+	"github.com/google/pprof/profile"
+	"github.com/ianlancetaylor/demangle"
+)
+
+// DemangleMode decides how the C++ and Rust function names of the profiles are demangled.
+type DemangleMode string
+
+const (
+	// DemangleFull demangles names with their template and function parameters.
+	DemangleFull DemangleMode = "full"
+	// DemangleSimplified demangles names without their template and function parameters.
+	DemangleSimplified DemangleMode = "simplified"
+	// DemangleNone keeps the names mangled.
+	DemangleNone DemangleMode = "none"
+)
+
+// ParseDemangleMode validates the given demangling mode.
+func ParseDemangleMode(s string) (DemangleMode, error) {
+	switch m := DemangleMode(s); m {
+	case DemangleFull, DemangleSimplified, DemangleNone:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown demangle mode %q", s)
+	}
+}
+
+// demangleFunctions demangles the names of the given functions, the mangled names are kept as their system names.
+// Names that aren't mangled are left untouched.
+func demangleFunctions(mode DemangleMode, functions []*profile.Function) {
+	if mode == DemangleNone {
+		return
+	}
+	options := []demangle.Option{demangle.NoClones}
+	if mode == DemangleSimplified {
+		options = []demangle.Option{demangle.NoParams, demangle.NoTemplateParams}
+	}
+
+	for _, f := range functions {
+		if f.SystemName == "" {
+			continue
+		}
+		name, err := demangle.ToString(f.SystemName, options...)
+		if err != nil {
+			continue
+		}
+		f.Name = name
+	}
+}
@@ -0,0 +1,830 @@
+package profiler
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Always needs to be sync with the CFA_TYPE_* and RBP_TYPE_* definitions in BPF program.
+const (
+	// cfaTypeEnd marks addresses without unwind information.
+	cfaTypeEnd uint8 = iota
+	cfaTypeRSP
+	cfaTypeRBP
+	// cfaTypeUnsupported marks addresses whose CFA is computed by a DWARF expression or from other registers.
+	cfaTypeUnsupported
+)
+
+const (
+	rbpTypeUnchanged uint8 = iota
+	rbpTypeOffset
+)
+
+// x86_64 DWARF register numbers.
+const (
+	dwarfRegRBP = 6
+	dwarfRegRSP = 7
+)
+
+// unwindRow describes how to find the caller frame of the instructions starting at PC.
+// Always needs to be sync with unwind_row_t in BPF program.
+type unwindRow struct {
+	PC        uint64
+	CFAType   uint8
+	RBPType   uint8
+	CFAOffset int16
+	RBPOffset int16
+	Padding   uint16
+}
+
+// DWARF call frame instructions, see section 6.4.2 of the DWARF 5 standard.
+const (
+	dwCFAAdvanceLoc = 0x40
+	dwCFAOffset     = 0x80
+	dwCFARestore    = 0xc0
+
+	dwCFANop                       = 0x00
+	dwCFASetLoc                    = 0x01
+	dwCFAAdvanceLoc1               = 0x02
+	dwCFAAdvanceLoc2               = 0x03
+	dwCFAAdvanceLoc4               = 0x04
+	dwCFAOffsetExtended            = 0x05
+	dwCFARestoreExtended           = 0x06
+	dwCFAUndefined                 = 0x07
+	dwCFASameValue                 = 0x08
+	dwCFARegister                  = 0x09
+	dwCFARememberState             = 0x0a
+	dwCFARestoreState              = 0x0b
+	dwCFADefCFA                    = 0x0c
+	dwCFADefCFARegister            = 0x0d
+	dwCFADefCFAOffset              = 0x0e
+	dwCFADefCFAExpression          = 0x0f
+	dwCFAExpression                = 0x10
+	dwCFAOffsetExtendedSf          = 0x11
+	dwCFADefCFASf                  = 0x12
+	dwCFADefCFAOffsetSf            = 0x13
+	dwCFAValOffset                 = 0x14
+	dwCFAValOffsetSf               = 0x15
+	dwCFAValExpression             = 0x16
+	dwCFAGNUArgsSize               = 0x2e
+	dwCFAGNUNegativeOffsetExtended = 0x2f
+)
+
+// Pointer encodings of .eh_frame, see the Linux Standard Base Core Specification.
+const (
+	dwEHPEAbsptr  = 0x00
+	dwEHPEUleb128 = 0x01
+	dwEHPEUdata2  = 0x02
+	dwEHPEUdata4  = 0x03
+	dwEHPEUdata8  = 0x04
+	dwEHPESleb128 = 0x09
+	dwEHPESdata2  = 0x0a
+	dwEHPESdata4  = 0x0b
+	dwEHPESdata8  = 0x0c
+	dwEHPEPcrel   = 0x10
+	dwEHPEOmit    = 0xff
+)
+
+var errUnsupportedEncoding = errors.New("unsupported pointer encoding")
+
+// frameSection is a .eh_frame or .debug_frame section being parsed.
+type frameSection struct {
+	data      []byte
+	addr      uint64
+	byteOrder binary.ByteOrder
+	ehFrame   bool
+
+	cies map[uint64]*cie
+}
+
+type cie struct {
+	codeAlign   uint64
+	dataAlign   int64
+	fdeEncoding byte
+	// augmented entries carry the length of their augmentation data.
+	augmented    bool
+	instructions []byte
+}
+
+// frameReader decodes the fields of a single entry.
+type frameReader struct {
+	s   *frameSection
+	buf []byte
+	// off is the offset of buf in the section.
+	off int
+}
+
+func (r *frameReader) u8() (byte, error) {
+	if len(r.buf) < 1 {
+		return 0, errors.New("unexpected end of entry")
+	}
+	v := r.buf[0]
+	r.skip(1)
+	return v, nil
+}
+
+func (r *frameReader) bytes(n uint64) ([]byte, error) {
+	if uint64(len(r.buf)) < n {
+		return nil, errors.New("unexpected end of entry")
+	}
+	v := r.buf[:n]
+	r.skip(int(n))
+	return v, nil
+}
+
+func (r *frameReader) u16() (uint16, error) {
+	b, err := r.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return r.s.byteOrder.Uint16(b), nil
+}
+
+func (r *frameReader) u32() (uint32, error) {
+	b, err := r.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return r.s.byteOrder.Uint32(b), nil
+}
+
+func (r *frameReader) u64() (uint64, error) {
+	b, err := r.bytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return r.s.byteOrder.Uint64(b), nil
+}
+
+func (r *frameReader) uleb() (uint64, error) {
+	var (
+		v     uint64
+		shift uint
+	)
+	for {
+		b, err := r.u8()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+}
+
+func (r *frameReader) sleb() (int64, error) {
+	var (
+		v     int64
+		shift uint
+		b     byte
+		err   error
+	)
+	for {
+		b, err = r.u8()
+		if err != nil {
+			return 0, err
+		}
+		v |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if shift < 64 && b&0x40 != 0 {
+		v |= -1 << shift
+	}
+	return v, nil
+}
+
+func (r *frameReader) cstring() (string, error) {
+	i := bytes.IndexByte(r.buf, 0)
+	if i < 0 {
+		return "", errors.New("unterminated string")
+	}
+	s := string(r.buf[:i])
+	r.skip(i + 1)
+	return s, nil
+}
+
+func (r *frameReader) skip(n int) {
+	r.buf = r.buf[n:]
+	r.off += n
+}
+
+// pointer reads a pointer with the given .eh_frame encoding.
+func (r *frameReader) pointer(enc byte) (uint64, error) {
+	if enc == dwEHPEOmit {
+		return 0, nil
+	}
+	fieldAddr := r.s.addr + uint64(r.off)
+
+	var (
+		v   uint64
+		err error
+	)
+	switch enc & 0x0f {
+	case dwEHPEAbsptr, dwEHPEUdata8, dwEHPESdata8:
+		v, err = r.u64()
+	case dwEHPEUleb128:
+		v, err = r.uleb()
+	case dwEHPEUdata2:
+		var u uint16
+		u, err = r.u16()
+		v = uint64(u)
+	case dwEHPEUdata4:
+		var u uint32
+		u, err = r.u32()
+		v = uint64(u)
+	case dwEHPESleb128:
+		var s int64
+		s, err = r.sleb()
+		v = uint64(s)
+	case dwEHPESdata2:
+		var u uint16
+		u, err = r.u16()
+		v = uint64(int64(int16(u)))
+	case dwEHPESdata4:
+		var u uint32
+		u, err = r.u32()
+		v = uint64(int64(int32(u)))
+	default:
+		return 0, errUnsupportedEncoding
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	switch enc & 0x70 {
+	case 0:
+	case dwEHPEPcrel:
+		v += fieldAddr
+	default:
+		return 0, errUnsupportedEncoding
+	}
+	return v, nil
+}
+
+// readUnwindRows builds the unwind table of the given x86_64 ELF file from its .eh_frame section,
+// or its .debug_frame section when there is none. Addresses are the virtual addresses of the file.
+func readUnwindRows(f *elf.File) ([]unwindRow, error) {
+	if f.Machine != elf.EM_X86_64 {
+		return nil, fmt.Errorf("unsupported machine %s", f.Machine)
+	}
+
+	var s *frameSection
+	for _, name := range []string{".eh_frame", ".debug_frame"} {
+		sec := f.Section(name)
+		if sec == nil || sec.Type == elf.SHT_NOBITS {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+		s = &frameSection{
+			data:      data,
+			addr:      sec.Addr,
+			byteOrder: f.ByteOrder,
+			ehFrame:   name == ".eh_frame",
+			cies:      map[uint64]*cie{},
+		}
+		break
+	}
+	if s == nil {
+		return nil, errors.New("no .eh_frame or .debug_frame section")
+	}
+	return s.rows()
+}
+
+// rows interprets the call frame instructions of every FDE in the section.
+func (s *frameSection) rows() ([]unwindRow, error) {
+	var rows []unwindRow
+	for off := 0; off < len(s.data); {
+		r := &frameReader{s: s, buf: s.data[off:], off: off}
+		length, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			// Terminator of .eh_frame.
+			if s.ehFrame {
+				break
+			}
+			off = r.off
+			continue
+		}
+
+		is64 := length == math.MaxUint32
+		entryLength := uint64(length)
+		if is64 {
+			if entryLength, err = r.u64(); err != nil {
+				return nil, err
+			}
+		}
+		if entryLength > uint64(len(r.buf)) {
+			return nil, fmt.Errorf("entry at %#x exceeds the section", off)
+		}
+		entry := &frameReader{s: s, buf: r.buf[:entryLength], off: r.off}
+		next := r.off + int(entryLength)
+
+		idOff := entry.off
+		var id uint64
+		if is64 {
+			id, err = entry.u64()
+		} else {
+			var id32 uint32
+			id32, err = entry.u32()
+			id = uint64(id32)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case s.isCIE(id, is64):
+			c, err := s.parseCIE(entry)
+			if err != nil {
+				return nil, fmt.Errorf("parse CIE at %#x: %w", off, err)
+			}
+			s.cies[uint64(off)] = c
+		default:
+			cieOff := id
+			if s.ehFrame {
+				// .eh_frame stores the distance to the CIE instead of its offset.
+				cieOff = uint64(idOff) - id
+			}
+			c, ok := s.cies[cieOff]
+			if !ok {
+				var err error
+				if c, err = s.cieAt(cieOff); err != nil {
+					return nil, fmt.Errorf("parse CIE of FDE at %#x: %w", off, err)
+				}
+			}
+			fdeRows, err := s.parseFDE(entry, c)
+			if err != nil {
+				if errors.Is(err, errUnsupportedEncoding) {
+					off = next
+					continue
+				}
+				return nil, fmt.Errorf("parse FDE at %#x: %w", off, err)
+			}
+			rows = append(rows, fdeRows...)
+		}
+		off = next
+	}
+
+	return compactRows(rows), nil
+}
+
+// compactRows sorts the given rows and drops the ones that don't change how to unwind.
+// The end of a function is often the start of the next one, which takes precedence.
+func compactRows(rows []unwindRow) []unwindRow {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].PC != rows[j].PC {
+			return rows[i].PC < rows[j].PC
+		}
+		return rows[i].CFAType == cfaTypeEnd && rows[j].CFAType != cfaTypeEnd
+	})
+
+	compacted := rows[:0]
+	for _, row := range rows {
+		n := len(compacted)
+		if n > 0 && compacted[n-1].PC == row.PC {
+			compacted[n-1] = row
+			continue
+		}
+		if n > 0 && sameUnwinding(compacted[n-1], row) {
+			continue
+		}
+		compacted = append(compacted, row)
+	}
+	return compacted
+}
+
+func sameUnwinding(a, b unwindRow) bool {
+	a.PC, b.PC = 0, 0
+	return a == b
+}
+
+func (s *frameSection) isCIE(id uint64, is64 bool) bool {
+	if s.ehFrame {
+		return id == 0
+	}
+	if is64 {
+		return id == math.MaxUint64
+	}
+	return id == math.MaxUint32
+}
+
+// cieAt parses the CIE at the given offset, for FDEs that precede their CIE.
+func (s *frameSection) cieAt(off uint64) (*cie, error) {
+	if off >= uint64(len(s.data)) {
+		return nil, fmt.Errorf("CIE offset %#x out of bounds", off)
+	}
+	r := &frameReader{s: s, buf: s.data[off:], off: int(off)}
+	length, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	is64 := length == math.MaxUint32
+	entryLength := uint64(length)
+	if is64 {
+		if entryLength, err = r.u64(); err != nil {
+			return nil, err
+		}
+		// Skip the CIE ID.
+		if _, err := r.u64(); err != nil {
+			return nil, err
+		}
+	} else if _, err := r.u32(); err != nil {
+		return nil, err
+	}
+	idLen := uint64(4)
+	if is64 {
+		idLen = 8
+	}
+	if entryLength < idLen || entryLength-idLen > uint64(len(r.buf)) {
+		return nil, errors.New("CIE exceeds the section")
+	}
+	r.buf = r.buf[:entryLength-idLen]
+
+	c, err := s.parseCIE(r)
+	if err != nil {
+		return nil, err
+	}
+	s.cies[off] = c
+	return c, nil
+}
+
+func (s *frameSection) parseCIE(r *frameReader) (*cie, error) {
+	version, err := r.u8()
+	if err != nil {
+		return nil, err
+	}
+	augmentation, err := r.cstring()
+	if err != nil {
+		return nil, err
+	}
+	if version >= 4 {
+		// Address and segment selector sizes.
+		if _, err := r.bytes(2); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &cie{fdeEncoding: dwEHPEAbsptr}
+	if c.codeAlign, err = r.uleb(); err != nil {
+		return nil, err
+	}
+	if c.dataAlign, err = r.sleb(); err != nil {
+		return nil, err
+	}
+	// Return address register.
+	if version == 1 {
+		_, err = r.u8()
+	} else {
+		_, err = r.uleb()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(augmentation) > 0 && augmentation[0] == 'z' {
+		c.augmented = true
+		length, err := r.uleb()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.bytes(length)
+		if err != nil {
+			return nil, err
+		}
+		aug := &frameReader{s: s, buf: data, off: r.off - len(data)}
+	augmentations:
+		for _, ch := range augmentation[1:] {
+			switch ch {
+			case 'L':
+				// LSDA encoding.
+				if _, err := aug.u8(); err != nil {
+					return nil, err
+				}
+			case 'P':
+				enc, err := aug.u8()
+				if err != nil {
+					return nil, err
+				}
+				if _, err := aug.pointer(enc); err != nil {
+					return nil, err
+				}
+			case 'R':
+				if c.fdeEncoding, err = aug.u8(); err != nil {
+					return nil, err
+				}
+			case 'S', 'B':
+			default:
+				// The meaning of the remaining augmentation data is unknown, but its length is.
+				break augmentations
+			}
+		}
+	}
+	c.instructions = r.buf
+	return c, nil
+}
+
+func (s *frameSection) parseFDE(r *frameReader, c *cie) ([]unwindRow, error) {
+	enc := c.fdeEncoding
+	if !s.ehFrame {
+		enc = dwEHPEAbsptr
+	}
+	begin, err := r.pointer(enc)
+	if err != nil {
+		return nil, err
+	}
+	// The range is never relative.
+	pcRange, err := r.pointer(enc & 0x0f)
+	if err != nil {
+		return nil, err
+	}
+	if c.augmented {
+		length, err := r.uleb()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.bytes(length); err != nil {
+			return nil, err
+		}
+	}
+	if begin == 0 || pcRange == 0 {
+		// Discarded functions, e.g. of garbage collected sections.
+		return nil, nil
+	}
+
+	i := &cfaInterpreter{s: s, cie: c, loc: begin}
+	if err := i.run(c.instructions, enc); err != nil {
+		return nil, fmt.Errorf("run CIE instructions: %w", err)
+	}
+	i.initial = i.state
+	if err := i.run(r.buf, enc); err != nil {
+		return nil, fmt.Errorf("run FDE instructions: %w", err)
+	}
+	i.emit()
+	i.rows = append(i.rows, unwindRow{PC: begin + pcRange, CFAType: cfaTypeEnd})
+	return i.rows, nil
+}
+
+// cfaState is the part of a row of the DWARF call frame table the unwinder needs.
+type cfaState struct {
+	cfaRegister   uint64
+	cfaOffset     int64
+	cfaExpression bool
+
+	rbpSaved  bool
+	rbpOffset int64
+}
+
+type cfaInterpreter struct {
+	s   *frameSection
+	cie *cie
+
+	loc     uint64
+	state   cfaState
+	initial cfaState
+	stack   []cfaState
+
+	rows []unwindRow
+}
+
+// emit records the current state as the row of the current location.
+func (i *cfaInterpreter) emit() {
+	row := unwindRow{PC: i.loc, CFAType: cfaTypeUnsupported}
+	switch {
+	case i.state.cfaExpression:
+	case i.state.cfaOffset < math.MinInt16 || i.state.cfaOffset > math.MaxInt16:
+	case i.state.cfaRegister == dwarfRegRSP:
+		row.CFAType = cfaTypeRSP
+		row.CFAOffset = int16(i.state.cfaOffset)
+	case i.state.cfaRegister == dwarfRegRBP:
+		row.CFAType = cfaTypeRBP
+		row.CFAOffset = int16(i.state.cfaOffset)
+	}
+
+	if i.state.rbpSaved && i.state.rbpOffset >= math.MinInt16 && i.state.rbpOffset <= math.MaxInt16 {
+		row.RBPType = rbpTypeOffset
+		row.RBPOffset = int16(i.state.rbpOffset)
+	}
+
+	if n := len(i.rows); n > 0 && i.rows[n-1].PC == row.PC {
+		i.rows[n-1] = row
+		return
+	}
+	i.rows = append(i.rows, row)
+}
+
+func (i *cfaInterpreter) advance(delta uint64) {
+	i.emit()
+	i.loc += delta * i.cie.codeAlign
+}
+
+func (i *cfaInterpreter) setRBP(reg uint64, saved bool, offset int64) {
+	if reg != dwarfRegRBP {
+		return
+	}
+	i.state.rbpSaved = saved
+	i.state.rbpOffset = offset
+}
+
+func (i *cfaInterpreter) run(instructions []byte, enc byte) error {
+	r := &frameReader{s: i.s, buf: instructions}
+	for len(r.buf) > 0 {
+		op, err := r.u8()
+		if err != nil {
+			return err
+		}
+
+		switch op & 0xc0 {
+		case dwCFAAdvanceLoc:
+			i.advance(uint64(op & 0x3f))
+			continue
+		case dwCFAOffset:
+			off, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			i.setRBP(uint64(op&0x3f), true, int64(off)*i.cie.dataAlign)
+			continue
+		case dwCFARestore:
+			if uint64(op&0x3f) == dwarfRegRBP {
+				i.state.rbpSaved, i.state.rbpOffset = i.initial.rbpSaved, i.initial.rbpOffset
+			}
+			continue
+		}
+
+		switch op {
+		case dwCFANop:
+		case dwCFASetLoc:
+			loc, err := r.pointer(enc)
+			if err != nil {
+				return err
+			}
+			i.emit()
+			i.loc = loc
+		case dwCFAAdvanceLoc1:
+			delta, err := r.u8()
+			if err != nil {
+				return err
+			}
+			i.advance(uint64(delta))
+		case dwCFAAdvanceLoc2:
+			delta, err := r.u16()
+			if err != nil {
+				return err
+			}
+			i.advance(uint64(delta))
+		case dwCFAAdvanceLoc4:
+			delta, err := r.u32()
+			if err != nil {
+				return err
+			}
+			i.advance(uint64(delta))
+		case dwCFAOffsetExtended, dwCFAGNUNegativeOffsetExtended:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			off, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			offset := int64(off) * i.cie.dataAlign
+			if op == dwCFAGNUNegativeOffsetExtended {
+				offset = -offset
+			}
+			i.setRBP(reg, true, offset)
+		case dwCFAOffsetExtendedSf:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			off, err := r.sleb()
+			if err != nil {
+				return err
+			}
+			i.setRBP(reg, true, off*i.cie.dataAlign)
+		case dwCFARestoreExtended:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			if reg == dwarfRegRBP {
+				i.state.rbpSaved, i.state.rbpOffset = i.initial.rbpSaved, i.initial.rbpOffset
+			}
+		case dwCFAUndefined, dwCFASameValue:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			i.setRBP(reg, false, 0)
+		case dwCFARegister, dwCFAValOffset:
+			// Treated as unchanged, the unwinder only follows values saved on the stack.
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			if _, err := r.uleb(); err != nil {
+				return err
+			}
+			i.setRBP(reg, false, 0)
+		case dwCFAValOffsetSf:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			if _, err := r.sleb(); err != nil {
+				return err
+			}
+			i.setRBP(reg, false, 0)
+		case dwCFARememberState:
+			i.stack = append(i.stack, i.state)
+		case dwCFARestoreState:
+			if len(i.stack) == 0 {
+				return errors.New("restore state without remembered state")
+			}
+			i.state = i.stack[len(i.stack)-1]
+			i.stack = i.stack[:len(i.stack)-1]
+		case dwCFADefCFA:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			off, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			i.state.cfaRegister, i.state.cfaOffset, i.state.cfaExpression = reg, int64(off), false
+		case dwCFADefCFASf:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			off, err := r.sleb()
+			if err != nil {
+				return err
+			}
+			i.state.cfaRegister, i.state.cfaOffset, i.state.cfaExpression = reg, off*i.cie.dataAlign, false
+		case dwCFADefCFARegister:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			i.state.cfaRegister, i.state.cfaExpression = reg, false
+		case dwCFADefCFAOffset:
+			off, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			i.state.cfaOffset = int64(off)
+		case dwCFADefCFAOffsetSf:
+			off, err := r.sleb()
+			if err != nil {
+				return err
+			}
+			i.state.cfaOffset = off * i.cie.dataAlign
+		case dwCFADefCFAExpression:
+			length, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			if _, err := r.bytes(length); err != nil {
+				return err
+			}
+			i.state.cfaExpression = true
+		case dwCFAExpression, dwCFAValExpression:
+			reg, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			length, err := r.uleb()
+			if err != nil {
+				return err
+			}
+			if _, err := r.bytes(length); err != nil {
+				return err
+			}
+			i.setRBP(reg, false, 0)
+		case dwCFAGNUArgsSize:
+			if _, err := r.uleb(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown call frame instruction %#x", op)
+		}
+	}
+	return nil
+}
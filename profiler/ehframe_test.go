@@ -0,0 +1,196 @@
+package profiler
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	readelfCIE = regexp.MustCompile(`^([0-9a-f]+) [0-9a-f]+ [0-9a-f]+ CIE`)
+	readelfFDE = regexp.MustCompile(`^[0-9a-f]+ [0-9a-f]+ [0-9a-f]+ FDE cie=([0-9a-f]+) pc=([0-9a-f]+)\.\.([0-9a-f]+)`)
+	readelfRow = regexp.MustCompile(`^[0-9a-f]{16} `)
+)
+
+// readelfFrameRow is a row of the call frame table as printed by readelf, with the columns the unwinder needs.
+type readelfFrameRow struct {
+	loc      uint64
+	cfa, rbp string
+}
+
+// readelfFrames returns the rows of the .eh_frame call frame table of the given file as interpreted by readelf,
+// FDEs without instructions get the initial row of their CIE.
+func readelfFrames(t *testing.T, path string) []readelfFrameRow {
+	t.Helper()
+	out, err := exec.Command("readelf", "--debug-dump=frames-interp", path).Output()
+	if err != nil {
+		t.Skipf("readelf: %v", err)
+	}
+
+	var (
+		rows       []readelfFrameRow
+		cieRows    = map[string]readelfFrameRow{}
+		columns    []string
+		cie        string
+		inCIE      bool
+		fdeBegin   uint64
+		fdeHasRows bool
+	)
+	// flushFDE adds the initial row of the CIE of the previous FDE, when it has no rows of its own.
+	flushFDE := func() {
+		if !inCIE && cie != "" && !fdeHasRows && fdeBegin != 0 {
+			row := cieRows[cie]
+			row.loc = fdeBegin
+			rows = append(rows, row)
+		}
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "Contents of the ") && !strings.Contains(line, ".eh_frame") {
+			// The unwinder prefers .eh_frame.
+			break
+		}
+		if m := readelfCIE.FindStringSubmatch(line); m != nil {
+			flushFDE()
+			cie, inCIE = m[1], true
+			continue
+		}
+		if m := readelfFDE.FindStringSubmatch(line); m != nil {
+			flushFDE()
+			cie, inCIE, fdeHasRows = m[1], false, false
+			if fdeBegin, err = strconv.ParseUint(m[2], 16, 64); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "LOC" {
+			columns = fields
+			continue
+		}
+		if !readelfRow.MatchString(line) {
+			continue
+		}
+
+		loc, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row := readelfFrameRow{loc: loc, rbp: "u"}
+		for i, column := range columns {
+			if i >= len(fields) {
+				break
+			}
+			switch column {
+			case "CFA":
+				row.cfa = fields[i]
+			case "rbp":
+				row.rbp = fields[i]
+			}
+		}
+		if inCIE {
+			cieRows[cie] = row
+			continue
+		}
+		fdeHasRows = true
+		if fdeBegin != 0 {
+			rows = append(rows, row)
+		}
+	}
+	flushFDE()
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// wantUnwindRow converts a readelf row to the unwind row it should result in.
+// It returns false when how the rbp register is recovered can't be told from readelf's output.
+func wantUnwindRow(t *testing.T, r readelfFrameRow) (unwindRow, bool) {
+	t.Helper()
+	want := unwindRow{PC: r.loc, CFAType: cfaTypeUnsupported}
+	for prefix, cfaType := range map[string]uint8{"rsp+": cfaTypeRSP, "rbp+": cfaTypeRBP} {
+		if !strings.HasPrefix(r.cfa, prefix) {
+			continue
+		}
+		offset, err := strconv.ParseInt(strings.TrimPrefix(r.cfa, prefix), 10, 64)
+		if err != nil {
+			t.Fatalf("parse CFA %q: %v", r.cfa, err)
+		}
+		if offset >= -1<<15 && offset < 1<<15 {
+			want.CFAType, want.CFAOffset = cfaType, int16(offset)
+		}
+	}
+
+	switch {
+	case r.rbp == "u" || r.rbp == "s":
+	case strings.HasPrefix(r.rbp, "c"):
+		offset, err := strconv.ParseInt(r.rbp[1:], 10, 64)
+		if err != nil {
+			t.Fatalf("parse rbp %q: %v", r.rbp, err)
+		}
+		want.RBPType, want.RBPOffset = rbpTypeOffset, int16(offset)
+	default:
+		return want, false
+	}
+	return want, true
+}
+
+func TestUnwindRowsMatchReadelf(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("unwind tables are only built for x86_64")
+	}
+	// readelf itself is a real binary with a .eh_frame section wherever it is installed.
+	path, err := exec.LookPath("readelf")
+	if err != nil {
+		t.Skip(err)
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Section(".eh_frame") == nil {
+		t.Skipf("%s has no .eh_frame section", path)
+	}
+	rows, err := readUnwindRows(f)
+	if err != nil {
+		t.Fatalf("read unwind rows of %s: %v", path, err)
+	}
+
+	want := readelfFrames(t, path)
+	if len(want) == 0 {
+		t.Fatalf("readelf found no call frame table in %s", path)
+	}
+	for _, r := range want {
+		wantRow, rbpKnown := wantUnwindRow(t, r)
+
+		// The rows apply up to the next one.
+		i := sort.Search(len(rows), func(i int) bool { return rows[i].PC > r.loc }) - 1
+		if i < 0 {
+			t.Fatalf("no unwind row at %#x", r.loc)
+		}
+		got := rows[i]
+		got.PC = r.loc
+		if !rbpKnown {
+			got.RBPType, got.RBPOffset = wantRow.RBPType, wantRow.RBPOffset
+		}
+		if got != wantRow {
+			t.Errorf("got %+v at %#x, want %+v from CFA %s and rbp %s", got, r.loc, wantRow, r.cfa, r.rbp)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package profiler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// PerfEvent describes a perf event the profiler samples stacks on.
+type PerfEvent struct {
+	Name   string
+	Type   uint32
+	Config uint64
+	// DefaultPeriod is the amount of events between two samples of the events
+	// that aren't sampled at a fixed frequency.
+	DefaultPeriod uint64
+}
+
+// Clock based events are sampled at the sampling frequency, everything else every period events.
+func (e PerfEvent) frequencyBased() bool {
+	return e.Type == unix.PERF_TYPE_SOFTWARE && e.Config == unix.PERF_COUNT_SW_CPU_CLOCK
+}
+
+// profileName returns the __name__ label of the profiles built from this event.
+func (e PerfEvent) profileName() string {
+	if e.frequencyBased() {
+		return "tiny_profiler_cpu"
+	}
+	return "tiny_profiler_" + e.sampleTypeName()
+}
+
+func (e PerfEvent) sampleTypeName() string {
+	return strings.ReplaceAll(e.Name, "-", "_")
+}
+
+var (
+	// CPUClockEvent is the default event, it samples on-CPU stacks at a fixed frequency.
+	CPUClockEvent = PerfEvent{Name: "cpu-clock", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_CPU_CLOCK}
+
+	perfEvents = map[string]PerfEvent{
+		// Software events, these work on VMs without a PMU. Sampling every one of them would cost a BPF program
+		// run each, busy machines have hundreds of thousands of page faults and context switches a second.
+		CPUClockEvent.Name: CPUClockEvent,
+		"page-faults":      {Name: "page-faults", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_PAGE_FAULTS, DefaultPeriod: 1000},
+		"context-switches": {Name: "context-switches", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_CONTEXT_SWITCHES, DefaultPeriod: 1000},
+		"cpu-migrations":   {Name: "cpu-migrations", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_CPU_MIGRATIONS, DefaultPeriod: 100},
+		// Hardware events, these need a PMU that exposes them.
+		"cpu-cycles":    {Name: "cpu-cycles", Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_CPU_CYCLES, DefaultPeriod: 10000000},
+		"instructions":  {Name: "instructions", Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_INSTRUCTIONS, DefaultPeriod: 10000000},
+		"cache-misses":  {Name: "cache-misses", Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_CACHE_MISSES, DefaultPeriod: 10000},
+		"branch-misses": {Name: "branch-misses", Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_BRANCH_MISSES, DefaultPeriod: 10000},
+	}
+)
+
+// PerfEventNames returns the names of the supported perf events.
+func PerfEventNames() []string {
+	names := make([]string, 0, len(perfEvents))
+	for name := range perfEvents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParsePerfEvent looks up the perf event with the given name.
+func ParsePerfEvent(name string) (PerfEvent, error) {
+	e, ok := perfEvents[name]
+	if !ok {
+		return PerfEvent{}, fmt.Errorf("unknown perf event %q, supported events: %s", name, strings.Join(PerfEventNames(), ", "))
+	}
+	return e, nil
+}
+
+// samplePeriod returns the amount of events between two samples of non frequency based events.
+func (p *Profiler) samplePeriod() uint64 {
+	if p.perfEventPeriod != 0 {
+		return p.perfEventPeriod
+	}
+	return p.perfEvent.DefaultPeriod
+}
+
+// openPerfEvent opens the configured perf event on the given CPU.
+func (p *Profiler) openPerfEvent(cpu int) (int, error) {
+	attr := &unix.PerfEventAttr{
+		Type:   p.perfEvent.Type,
+		Config: p.perfEvent.Config,
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Bits:   unix.PerfBitDisabled,
+	}
+	if p.perfEvent.frequencyBased() {
+		attr.Sample = p.effectiveSamplingFrequency
+		attr.Bits |= unix.PerfBitFreq
+	} else {
+		attr.Sample = p.samplePeriod()
+	}
+
+	fd, err := unix.PerfEventOpen(attr, -1 /* pid */, cpu /* cpu id */, -1 /* group */, 0 /* flags */)
+	if err != nil {
+		if p.perfEvent.Type == unix.PERF_TYPE_HARDWARE && (errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP)) {
+			return 0, fmt.Errorf("perf event %s is not supported by the PMU of this machine: %w", p.perfEvent.Name, err)
+		}
+		return 0, err
+	}
+	return fd, nil
+}
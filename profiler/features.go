@@ -0,0 +1,131 @@
+package profiler
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// BPF instructions and helpers the feature probes use, same as in linux/bpf.h.
+const (
+	bpfMovImm = 0xb7 // BPF_ALU64 | BPF_MOV | BPF_K
+	bpfMovReg = 0xbf // BPF_ALU64 | BPF_MOV | BPF_X
+	bpfAddImm = 0x07 // BPF_ALU64 | BPF_ADD | BPF_K
+	bpfJltImm = 0xa5 // BPF_JMP | BPF_JLT | BPF_K
+	bpfCall   = 0x85 // BPF_JMP | BPF_CALL
+	bpfExit   = 0x95 // BPF_JMP | BPF_EXIT
+
+	bpfFuncProbeReadUser     = 112
+	bpfFuncProbeReadKernel   = 113
+	bpfFuncGetCurrentTaskBTF = 158
+	bpfFuncTaskPtRegs        = 175
+)
+
+// errKernelUnsupported is returned when the kernel lacks a feature the BPF programs need.
+var errKernelUnsupported = errors.New("unsupported kernel, Linux 5.5 or later is needed")
+
+// bpfInsn is an instruction of a BPF program, laid out like struct bpf_insn on little endian machines.
+type bpfInsn struct {
+	code   uint8
+	regs   uint8 // The source register in the high nibble, the destination register in the low one.
+	offset int16
+	imm    int32
+}
+
+// checkKernelFeatures returns an error when the kernel can't load the BPF programs, as the verifier errors
+// of an unsupported kernel are hard to make sense of. Features are probed rather than deduced from the kernel
+// version, as distributions backport them to older kernels. The memlock limit must already be raised.
+func checkKernelFeatures() error {
+	probeRead := func(helper int32) []bpfInsn {
+		return []bpfInsn{
+			{code: bpfMovReg, regs: 10<<4 | 1},  // r1 = r10
+			{code: bpfAddImm, regs: 1, imm: -8}, // r1 += -8
+			{code: bpfMovImm, regs: 2, imm: 8},  // r2 = 8
+			{code: bpfMovImm, regs: 3, imm: 0},  // r3 = 0
+			{code: bpfCall, imm: helper},        // call helper
+			{code: bpfMovImm, regs: 0, imm: 0},  // r0 = 0
+			{code: bpfExit},                     // exit
+		}
+	}
+	for _, probe := range []struct {
+		feature string
+		insns   []bpfInsn
+	}{
+		{feature: "bpf_probe_read_kernel helper", insns: probeRead(bpfFuncProbeReadKernel)},
+		{feature: "bpf_probe_read_user helper", insns: probeRead(bpfFuncProbeReadUser)},
+		{feature: "bounded loops", insns: []bpfInsn{
+			{code: bpfMovImm, regs: 0, imm: 0},             // r0 = 0
+			{code: bpfAddImm, regs: 0, imm: 1},             // r0 += 1
+			{code: bpfJltImm, regs: 0, offset: -2, imm: 4}, // if r0 < 4 goto -2
+			{code: bpfMovImm, regs: 0, imm: 0},             // r0 = 0
+			{code: bpfExit},                                // exit
+		}},
+	} {
+		supported, err := probeBPFProgram(probe.insns)
+		if err != nil {
+			return fmt.Errorf("probe %s: %w", probe.feature, err)
+		}
+		if !supported {
+			return fmt.Errorf("%w: no support for %s", errKernelUnsupported, probe.feature)
+		}
+	}
+	return nil
+}
+
+// checkDWARFUnwindingFeatures returns an error when the kernel can't walk user stacks using unwind tables,
+// the walker finds the user registers of tasks with the bpf_task_pt_regs helper.
+func checkDWARFUnwindingFeatures() error {
+	supported, err := probeBPFProgram([]bpfInsn{
+		{code: bpfCall, imm: bpfFuncGetCurrentTaskBTF}, // call bpf_get_current_task_btf
+		{code: bpfMovReg, regs: 0<<4 | 1},              // r1 = r0
+		{code: bpfCall, imm: bpfFuncTaskPtRegs},        // call bpf_task_pt_regs
+		{code: bpfMovImm, regs: 0, imm: 0},             // r0 = 0
+		{code: bpfExit},                                // exit
+	})
+	if err != nil {
+		return fmt.Errorf("probe bpf_task_pt_regs helper: %w", err)
+	}
+	if !supported {
+		return errors.New("unsupported kernel, DWARF unwinding needs Linux 5.15 or later: no support for bpf_task_pt_regs helper")
+	}
+	return nil
+}
+
+// probeBPFProgram reports whether the verifier accepts the given tracepoint program.
+func probeBPFProgram(insns []bpfInsn) (bool, error) {
+	license := []byte("GPL\x00")
+
+	// bpf_attr of BPF_PROG_LOAD, up to the fields the probes need.
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: unix.BPF_PROG_TYPE_TRACEPOINT,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	switch errno {
+	case 0:
+		unix.Close(int(fd))
+		return true, nil
+	case unix.EINVAL:
+		// The verifier rejects unknown helpers and back-edges.
+		return false, nil
+	default:
+		return false, errno
+	}
+}
@@ -0,0 +1,192 @@
+package profiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+const (
+	filterConfigMapName  = "filter_config"
+	filterPIDsMapName    = "filter_pids"
+	filterCgroupsMapName = "filter_cgroups"
+	filterCommsMapName   = "filter_comms"
+
+	taskCommLen = 16 // Always needs to be sync with TASK_COMM_LEN in BPF program.
+)
+
+// Filter restricts in-kernel sampling to the matching tasks.
+// A task is sampled when it matches any of the criteria, an empty filter samples every task.
+type Filter struct {
+	PIDs         []int    `json:"pids,omitempty"`
+	CommPrefixes []string `json:"comm_prefixes,omitempty"`
+	CgroupIDs    []uint64 `json:"cgroup_ids,omitempty"`
+}
+
+func (f Filter) empty() bool {
+	return len(f.PIDs) == 0 && len(f.CommPrefixes) == 0 && len(f.CgroupIDs) == 0
+}
+
+type filterMaps struct {
+	byteOrder binary.ByteOrder
+
+	config  *bpf.BPFMap
+	pids    *bpf.BPFMap
+	cgroups *bpf.BPFMap
+	comms   *bpf.BPFMap
+}
+
+func newFilterMaps(m *bpf.Module, byteOrder binary.ByteOrder) (*filterMaps, error) {
+	config, err := m.GetMap(filterConfigMapName)
+	if err != nil {
+		return nil, fmt.Errorf("get filter config map: %w", err)
+	}
+	pids, err := m.GetMap(filterPIDsMapName)
+	if err != nil {
+		return nil, fmt.Errorf("get filter pids map: %w", err)
+	}
+	cgroups, err := m.GetMap(filterCgroupsMapName)
+	if err != nil {
+		return nil, fmt.Errorf("get filter cgroups map: %w", err)
+	}
+	comms, err := m.GetMap(filterCommsMapName)
+	if err != nil {
+		return nil, fmt.Errorf("get filter comms map: %w", err)
+	}
+	return &filterMaps{byteOrder: byteOrder, config: config, pids: pids, cgroups: cgroups, comms: comms}, nil
+}
+
+// update replaces the contents of the filter maps with the given filter.
+// New entries are added before the stale ones are removed, so targets that stay in the filter are never missed.
+// The filter is disabled before its maps are emptied and enabled after they are filled, so no task is dropped
+// by a filter in between.
+func (m *filterMaps) update(f Filter) error {
+	if f.empty() {
+		if err := m.setEnabled(false); err != nil {
+			return err
+		}
+	}
+
+	pids := map[string][]byte{}
+	for _, pid := range f.PIDs {
+		key := make([]byte, 4)
+		m.byteOrder.PutUint32(key, uint32(pid))
+		pids[string(key)] = key
+	}
+
+	cgroups := map[string][]byte{}
+	for _, id := range f.CgroupIDs {
+		key := make([]byte, 8)
+		m.byteOrder.PutUint64(key, id)
+		cgroups[string(key)] = key
+	}
+
+	comms := map[string][]byte{}
+	for _, prefix := range f.CommPrefixes {
+		if len(prefix) > taskCommLen-1 {
+			// The kernel truncates task names, the trailing byte is always NUL.
+			prefix = prefix[:taskCommLen-1]
+		}
+		key := make([]byte, 4+taskCommLen)
+		m.byteOrder.PutUint32(key, uint32(len(prefix)*8))
+		copy(key[4:], prefix)
+		comms[string(key)] = key
+	}
+
+	for name, entries := range map[string]struct {
+		bpfMap *bpf.BPFMap
+		keys   map[string][]byte
+	}{
+		filterPIDsMapName:    {m.pids, pids},
+		filterCgroupsMapName: {m.cgroups, cgroups},
+		filterCommsMapName:   {m.comms, comms},
+	} {
+		if err := replaceKeys(entries.bpfMap, entries.keys); err != nil {
+			return fmt.Errorf("update %s: %w", name, err)
+		}
+	}
+
+	if !f.empty() {
+		return m.setEnabled(true)
+	}
+	return nil
+}
+
+// setEnabled turns the filter on or off in the kernel.
+func (m *filterMaps) setEnabled(enabled bool) error {
+	var value uint32
+	if enabled {
+		value = 1
+	}
+	zero := uint32(0)
+	if err := m.config.Update(unsafe.Pointer(&zero), unsafe.Pointer(&value)); err != nil {
+		return fmt.Errorf("update filter config: %w", err)
+	}
+	return nil
+}
+
+// replaceKeys makes the given set-like BPF map contain exactly the given keys.
+func replaceKeys(m *bpf.BPFMap, keys map[string][]byte) error {
+	one := uint8(1)
+	for _, key := range keys {
+		if err := m.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&one)); err != nil {
+			return fmt.Errorf("add key: %w", err)
+		}
+	}
+
+	var stale [][]byte
+	it := m.Iterator()
+	for it.Next() {
+		key := it.Key()
+		if _, ok := keys[string(key)]; !ok {
+			prev := make([]byte, len(key))
+			copy(prev, key)
+			stale = append(stale, prev)
+		}
+	}
+	if it.Err() != nil {
+		return fmt.Errorf("iterate keys: %w", it.Err())
+	}
+	for _, key := range stale {
+		if err := m.DeleteKey(unsafe.Pointer(&key[0])); err != nil {
+			return fmt.Errorf("delete key: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetFilter changes the in-kernel target filter.
+// It can be called at any time, filters set before the BPF program is loaded are applied once it is.
+func (p *Profiler) SetFilter(f Filter) error {
+	p.filterMtx.Lock()
+	defer p.filterMtx.Unlock()
+
+	p.filter = f
+	if p.filterMaps == nil {
+		return nil
+	}
+	return p.filterMaps.update(p.effectiveFilter())
+}
+
+// Filter returns the currently configured in-kernel target filter.
+func (p *Profiler) Filter() Filter {
+	p.filterMtx.Lock()
+	defer p.filterMtx.Unlock()
+
+	return p.filter
+}
+
+// effectiveFilter extends the configured filter with the explicitly listed target processes,
+// so those are the only ones stack-walked in the kernel.
+func (p *Profiler) effectiveFilter() Filter {
+	f := p.filter
+	if p.targets.mode == TargetPIDs {
+		f.PIDs = append([]int{}, f.PIDs...)
+		for pid := range p.targets.pids {
+			f.PIDs = append(f.PIDs, int(pid))
+		}
+	}
+	return f
+}
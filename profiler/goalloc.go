@@ -0,0 +1,159 @@
+package profiler
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/gops/goprocess"
+)
+
+const (
+	goMallocgcProgramName      = "go_mallocgc_enter"
+	goMallocgcStackProgramName = "go_mallocgc_stack_enter"
+
+	goMallocgcSymbol = "runtime.mallocgc"
+)
+
+// goAllocProbes attaches the allocation probes to the Go binaries of the targeted processes.
+type goAllocProbes struct {
+	logger  log.Logger
+	module  *bpf.Module
+	targets *targets
+
+	// attached holds the links of the binaries that are already probed, by probed PID, device and inode.
+	attached map[[3]uint64][]*bpf.BPFLink
+	// checked records the probe keys of the executables of the processes that were looked at, by PID,
+	// so processes are only looked at again once they execute another binary.
+	checked map[PID][3]uint64
+}
+
+func newGoAllocProbes(logger log.Logger, m *bpf.Module, t *targets) *goAllocProbes {
+	return &goAllocProbes{
+		logger:   logger,
+		module:   m,
+		targets:  t,
+		attached: map[[3]uint64][]*bpf.BPFLink{},
+		checked:  map[PID][3]uint64{},
+	}
+}
+
+// attach probes runtime.mallocgc of the Go processes that showed up since the last call,
+// and detaches the probes of the binaries no process runs anymore.
+func (g *goAllocProbes) attach() {
+	pids, err := g.targets.candidatePIDs()
+	if err != nil {
+		level.Warn(g.logger).Log("msg", "failed to list processes", "err", err)
+		return
+	}
+	var (
+		running = map[PID]struct{}{}
+		inUse   = map[[3]uint64]struct{}{}
+	)
+	for _, pid := range pids {
+		// The executable is probed through the link, which resolves to the binary the process runs,
+		// even when it has been replaced on disk since. Kernel threads have no executable.
+		path := filepath.Join("/proc", fmt.Sprintf("%d", pid), "exe")
+		probePID := g.targets.probePID(pid)
+		key, err := probeKey(probePID, path)
+		if err != nil {
+			continue
+		}
+		running[pid] = struct{}{}
+		inUse[key] = struct{}{}
+		if g.checked[pid] == key {
+			continue
+		}
+		g.checked[pid] = key
+		if _, ok := g.attached[key]; ok {
+			continue
+		}
+
+		ps, ok, err := goprocess.Find(int(pid))
+		if err != nil || !ok {
+			continue
+		}
+
+		// Binaries that can't be probed, e.g. because they are stripped, are not retried.
+		link, err := g.attachBinary(probePID, path, ps.BuildVersion)
+		if err != nil {
+			g.attached[key] = nil
+			level.Warn(g.logger).Log("msg", "failed to attach Go allocation probe", "path", ps.Path, "pid", pid, "err", err)
+			continue
+		}
+		g.attached[key] = []*bpf.BPFLink{link}
+		level.Debug(g.logger).Log("msg", "attached Go allocation probe", "path", ps.Path, "pid", probePID, "version", ps.BuildVersion)
+	}
+
+	for pid := range g.checked {
+		if _, ok := running[pid]; !ok {
+			delete(g.checked, pid)
+		}
+	}
+	detachUnused(g.logger, g.attached, inUse)
+}
+
+// close detaches every Go allocation probe.
+func (g *goAllocProbes) close() {
+	for key, links := range g.attached {
+		detachProbes(g.logger, links)
+		delete(g.attached, key)
+	}
+}
+
+func (g *goAllocProbes) attachBinary(pid int, path, version string) (*bpf.BPFLink, error) {
+	offsets, err := symbolOffsets(path, []string{goMallocgcSymbol})
+	if err != nil {
+		return nil, err
+	}
+	offset, ok := offsets[goMallocgcSymbol]
+	if !ok {
+		return nil, fmt.Errorf("symbol %s not found", goMallocgcSymbol)
+	}
+
+	name := goMallocgcStackProgramName
+	if goRegisterABI(version) {
+		name = goMallocgcProgramName
+	}
+	prog, err := g.module.GetProgram(name)
+	if err != nil {
+		return nil, fmt.Errorf("get bpf program: %w", err)
+	}
+	link, err := prog.AttachUprobe(pid, path, uint32(offset))
+	if err != nil {
+		return nil, fmt.Errorf("attach %s probe: %w", goMallocgcSymbol, err)
+	}
+	return link, nil
+}
+
+// goRegisterABI reports whether binaries built by the given Go version, e.g. go1.18.3,
+// pass function arguments in registers on the architecture the profiler runs on.
+func goRegisterABI(version string) bool {
+	parts := strings.Split(strings.TrimPrefix(version, "go"), ".")
+	if len(parts) < 2 || parts[0] != "1" {
+		// Unknown or future major versions.
+		return true
+	}
+	// Keep the leading digits only, to drop pre-release suffixes like 18rc1.
+	digits := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if digits < 0 {
+		digits = len(parts[1])
+	}
+	minor, err := strconv.Atoi(parts[1][:digits])
+	if err != nil {
+		return true
+	}
+	switch runtime.GOARCH {
+	case "amd64":
+		return minor >= 17
+	case "arm64":
+		return minor >= 18
+	default:
+		return false
+	}
+}
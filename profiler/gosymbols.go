@@ -0,0 +1,433 @@
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	burrow "github.com/goburrow/cache"
+	"github.com/google/pprof/profile"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+)
+
+// Magic numbers of the pclntab headers that can be read, older tables are left to the ELF symbols.
+const (
+	go118PclntabMagic = 0xfffffff0 // Go 1.18 and 1.19.
+	go120PclntabMagic = 0xfffffff1 // Go 1.20 and later.
+)
+
+const (
+	goPCDataInlTreeIndex = 2 // Always needs to be sync with _PCDATA_InlTreeIndex of the Go runtime.
+	goFuncDataInlTree    = 3 // Always needs to be sync with _FUNCDATA_InlTree of the Go runtime.
+)
+
+var errNoPclntab = errors.New("no .gopclntab section")
+
+// goFrame is the source position of a Go function at an address, the function may be inlined.
+type goFrame struct {
+	function  string
+	file      string
+	line      int64
+	startLine int64
+}
+
+// goSymbols resolves the addresses of a Go binary using its pclntab, the table the Go runtime uses for tracebacks.
+// The table stays in the binary even when it is stripped.
+type goSymbols struct {
+	byteOrder binary.ByteOrder
+	magic     uint32
+	quantum   uint64
+	textStart uint64
+	nfunc     int
+
+	funcnametab []byte
+	cutab       []byte
+	filetab     []byte
+	pctab       []byte
+	// pclntable starts with the function table, entry and _func offset pairs, followed by the _func structs.
+	pclntable []byte
+
+	// gofunc holds the function data, e.g. inline trees, the _func structs point to. It is empty when it can't be found.
+	gofunc []byte
+}
+
+// GoSymbolizer resolves the user locations of Go binaries using their pclntab, which also gives
+// the source lines and the inlined calls. Locations of other object files are left untouched.
+// The addresses of the locations are expected to be normalized.
+type GoSymbolizer struct {
+	logger       log.Logger
+	objFileCache objectfile.Cache
+	symbolCache  burrow.Cache
+}
+
+// NewGoSymbolizer creates a Go symbolizer that opens object files through the given cache,
+// which is meant to be shared with the profiler.
+func NewGoSymbolizer(logger log.Logger, objFileCache objectfile.Cache) *GoSymbolizer {
+	return &GoSymbolizer{
+		logger:       logger,
+		objFileCache: objFileCache,
+		symbolCache:  burrow.New(burrow.WithMaximumSize(32)),
+	}
+}
+
+func (s *GoSymbolizer) Symbolize(_ context.Context, _ []*profile.Location, userLocations map[uint32][]*profile.Location) ([]*profile.Function, error) {
+	functions := newUserFunctions()
+	for pid, locations := range userLocations {
+		for _, loc := range locations {
+			if !symbolizable(loc) {
+				continue
+			}
+			m := loc.Mapping
+
+			symbols := s.symbols(pid, m)
+			if symbols == nil {
+				continue
+			}
+			frames, ok := symbols.lookup(loc.Address)
+			if !ok {
+				continue
+			}
+			for _, frame := range frames {
+				loc.Line = append(loc.Line, profile.Line{
+					Function: functions.get(m, frame.function, frame.file, frame.startLine),
+					Line:     frame.line,
+				})
+			}
+			m.HasFunctions = true
+			m.HasFilenames = true
+			m.HasLineNumbers = true
+			m.HasInlineFrames = true
+		}
+	}
+	return functions.functions, nil
+}
+
+// symbols returns the pclntab of the Go binary behind the given mapping of a process,
+// it returns nil for object files that aren't Go binaries.
+func (s *GoSymbolizer) symbols(pid uint32, m *profile.Mapping) *goSymbols {
+	objFile, err := s.objFileCache.ObjectFileForProcess(pid, m)
+	if err != nil {
+		return nil
+	}
+	key := objectFileKey(objFile)
+	if val, ok := s.symbolCache.GetIfPresent(key); ok {
+		//nolint:forcetypeassert
+		return val.(*goSymbols)
+	}
+
+	symbols, err := readGoSymbols(objFile.Path)
+	if err != nil {
+		if !errors.Is(err, errNoPclntab) {
+			level.Debug(s.logger).Log("msg", "failed to read pclntab", "pid", pid, "file", m.File, "err", err)
+		}
+		// Don't try again, other symbolizers handle the file.
+		symbols = nil
+	}
+	s.symbolCache.Put(key, symbols)
+	return symbols
+}
+
+// readGoSymbols reads the pclntab of the given Go binary.
+func readGoSymbols(path string) (*goSymbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open elf file: %w", err)
+	}
+	defer f.Close()
+
+	sec := f.Section(".gopclntab")
+	if sec == nil {
+		return nil, errNoPclntab
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("read .gopclntab: %w", err)
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("invalid .gopclntab header")
+	}
+
+	s := &goSymbols{
+		byteOrder: f.ByteOrder,
+		magic:     f.ByteOrder.Uint32(data),
+		quantum:   uint64(data[6]),
+	}
+	if s.magic != go118PclntabMagic && s.magic != go120PclntabMagic {
+		return nil, fmt.Errorf("unsupported pclntab magic %#x", s.magic)
+	}
+	ptrSize := int(data[7])
+	if ptrSize != 4 && ptrSize != 8 {
+		return nil, fmt.Errorf("invalid pointer size %d", ptrSize)
+	}
+
+	// The header fields following the magic are nfunc, nfiles, textStart
+	// and the offsets of funcnametab, cutab, filetab, pctab and pclntable.
+	if len(data) < 8+8*ptrSize {
+		return nil, fmt.Errorf("invalid .gopclntab header")
+	}
+	header := make([]uint64, 8)
+	for i := range header {
+		if ptrSize == 8 {
+			header[i] = f.ByteOrder.Uint64(data[8+i*ptrSize:])
+		} else {
+			header[i] = uint64(f.ByteOrder.Uint32(data[8+i*ptrSize:]))
+		}
+	}
+	for _, off := range header[3:] {
+		if off > uint64(len(data)) {
+			return nil, fmt.Errorf("invalid .gopclntab header")
+		}
+	}
+	s.nfunc = int(header[0])
+	s.textStart = header[2]
+	s.funcnametab = data[header[3]:]
+	s.cutab = data[header[4]:]
+	s.filetab = data[header[5]:]
+	s.pctab = data[header[6]:]
+	s.pclntable = data[header[7]:]
+	if len(s.pclntable) < (s.nfunc+1)*8 {
+		return nil, fmt.Errorf("invalid function table")
+	}
+
+	// Position independent binaries leave the text start to be relocated.
+	if s.textStart == 0 {
+		text := f.Section(".text")
+		if text == nil {
+			return nil, fmt.Errorf("no .text section")
+		}
+		s.textStart = text.Addr
+	}
+
+	if addr := goFuncAddress(f, sec.Addr, sec.Addr+header[3], ptrSize); addr != 0 {
+		for _, candidate := range f.Sections {
+			if candidate.Type == elf.SHT_NOBITS || candidate.Flags&elf.SHF_ALLOC == 0 {
+				continue
+			}
+			if addr < candidate.Addr || addr >= candidate.Addr+candidate.Size {
+				continue
+			}
+			d := data
+			if candidate != sec {
+				if d, err = candidate.Data(); err != nil {
+					break
+				}
+			}
+			s.gofunc = d[addr-candidate.Addr:]
+			break
+		}
+	}
+	return s, nil
+}
+
+// goFuncAddress returns the address of the function data of a Go binary, or 0 when it can't be found.
+func goFuncAddress(f *elf.File, pclntabAddr, funcnametabAddr uint64, ptrSize int) uint64 {
+	if syms, err := f.Symbols(); err == nil {
+		for _, sym := range syms {
+			// The symbol got renamed in Go 1.20.
+			if sym.Name == "go:func.*" || sym.Name == "go.func.*" {
+				return sym.Value
+			}
+		}
+	}
+
+	// Stripped binaries still have the runtime module data, which starts with
+	// pointers to the pclntab header and the function name table.
+	// The rodata and gofunc fields are always next to each other, past the text fields.
+	rodata := f.Section(".rodata")
+	if rodata == nil {
+		return 0
+	}
+	const (
+		firstField = 23
+		lastField  = 50
+	)
+	for _, name := range []string{".go.module", ".noptrdata", ".data"} {
+		sec := f.Section(name)
+		if sec == nil {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			continue
+		}
+		word := func(off int) uint64 {
+			if ptrSize == 8 {
+				return f.ByteOrder.Uint64(data[off:])
+			}
+			return uint64(f.ByteOrder.Uint32(data[off:]))
+		}
+		for off := 0; off+(lastField+2)*ptrSize <= len(data); off += ptrSize {
+			if word(off) != pclntabAddr || word(off+ptrSize) != funcnametabAddr {
+				continue
+			}
+			for i := lastField; i >= firstField; i-- {
+				if word(off+i*ptrSize) == rodata.Addr {
+					return word(off + (i+1)*ptrSize)
+				}
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// lookup returns the source positions of the given address, the innermost inlined function first.
+func (s *goSymbols) lookup(pc uint64) ([]goFrame, bool) {
+	if pc < s.textStart || pc-s.textStart > uint64(^uint32(0)) {
+		return nil, false
+	}
+	off := uint32(pc - s.textStart)
+
+	i := sort.Search(s.nfunc, func(i int) bool { return s.u32(s.pclntable, 8*i) > off }) - 1
+	if i < 0 || off >= s.u32(s.pclntable, 8*s.nfunc) {
+		return nil, false
+	}
+	funcOff := int(s.u32(s.pclntable, 8*i+4))
+	if funcOff >= len(s.pclntable) {
+		return nil, false
+	}
+	fn := s.pclntable[funcOff:]
+
+	// The _func struct is followed by the pcdata and funcdata offsets.
+	var (
+		entry     = s.textStart + uint64(s.u32(fn, 0))
+		nameOff   = s.u32(fn, 4)
+		pcfile    = s.u32(fn, 20)
+		pcln      = s.u32(fn, 24)
+		npcdata   = s.u32(fn, 28)
+		cuOffset  = s.u32(fn, 32)
+		startLine int64
+		nfuncdata uint32
+		size      = 40
+	)
+	if s.magic == go120PclntabMagic {
+		startLine = int64(int32(s.u32(fn, 36)))
+		size = 44
+	}
+	if len(fn) < size {
+		return nil, false
+	}
+	nfuncdata = uint32(fn[size-1])
+
+	position := func(pc uint64) (string, int64) {
+		file, line := "?", int64(0)
+		if fileno, ok := s.pcvalue(pcfile, entry, pc); ok && fileno >= 0 {
+			if fileOff := s.u32(s.cutab, 4*int(cuOffset+uint32(fileno))); fileOff != ^uint32(0) {
+				file = cString(s.filetab, fileOff)
+			}
+		}
+		if l, ok := s.pcvalue(pcln, entry, pc); ok {
+			line = int64(l)
+		}
+		return file, line
+	}
+
+	var frames []goFrame
+	if npcdata > goPCDataInlTreeIndex && nfuncdata > goFuncDataInlTree {
+		inlTreeIndex := s.u32(fn, size+4*goPCDataInlTreeIndex)
+		inlTreeOff := s.u32(fn, size+4*int(npcdata)+4*goFuncDataInlTree)
+		if inlTreeOff != ^uint32(0) && int(inlTreeOff) < len(s.gofunc) {
+			inlTree := s.gofunc[inlTreeOff:]
+			callSize := 20
+			if s.magic == go120PclntabMagic {
+				callSize = 16
+			}
+
+			ix, ok := s.pcvalue(inlTreeIndex, entry, pc)
+			// Bound the walk, a corrupt tree must not loop forever.
+			for depth := 0; ok && ix >= 0 && depth < 128; depth++ {
+				if (int(ix)+1)*callSize > len(inlTree) {
+					break
+				}
+				call := inlTree[int(ix)*callSize:]
+
+				frame := goFrame{}
+				var parentPC uint32
+				if s.magic == go120PclntabMagic {
+					frame.function = cString(s.funcnametab, s.u32(call, 4))
+					parentPC = s.u32(call, 8)
+					frame.startLine = int64(int32(s.u32(call, 12)))
+				} else {
+					frame.function = cString(s.funcnametab, s.u32(call, 12))
+					parentPC = s.u32(call, 16)
+				}
+				frame.file, frame.line = position(pc)
+				frames = append(frames, frame)
+
+				// The parent PC is an instruction of the caller at the position of the call.
+				pc = entry + uint64(parentPC)
+				ix, ok = s.pcvalue(inlTreeIndex, entry, pc)
+			}
+		}
+	}
+
+	file, line := position(pc)
+	frames = append(frames, goFrame{
+		function:  cString(s.funcnametab, nameOff),
+		file:      file,
+		line:      line,
+		startLine: startLine,
+	})
+	return frames, true
+}
+
+// pcvalue returns the value of the given pc-value table at the given address, tables are a sequence of
+// value and address delta pairs, starting at the function entry and -1.
+func (s *goSymbols) pcvalue(off uint32, entry, targetPC uint64) (int32, bool) {
+	if off == 0 || int(off) >= len(s.pctab) {
+		return -1, false
+	}
+	p := s.pctab[off:]
+	val := int32(-1)
+	pc := entry
+	for first := true; ; first = false {
+		uvdelta, n := binary.Uvarint(p)
+		if n <= 0 || uvdelta == 0 && !first {
+			return -1, false
+		}
+		p = p[n:]
+		// Value deltas are zig-zag encoded.
+		if uvdelta&1 != 0 {
+			uvdelta = ^(uvdelta >> 1)
+		} else {
+			uvdelta >>= 1
+		}
+		val += int32(uvdelta)
+
+		pcdelta, n := binary.Uvarint(p)
+		if n <= 0 {
+			return -1, false
+		}
+		p = p[n:]
+		pc += pcdelta * s.quantum
+		if targetPC < pc {
+			return val, true
+		}
+	}
+}
+
+// u32 reads the 32 bit value at the given offset, out of bounds reads return 0.
+func (s *goSymbols) u32(b []byte, off int) uint32 {
+	if off < 0 || off+4 > len(b) {
+		return 0
+	}
+	return s.byteOrder.Uint32(b[off:])
+}
+
+// cString returns the NUL terminated string at the given offset.
+func cString(b []byte, off uint32) string {
+	if int(off) >= len(b) {
+		return "?"
+	}
+	b = b[off:]
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
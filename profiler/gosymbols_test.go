@@ -0,0 +1,166 @@
+package profiler
+
+import (
+	"bufio"
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// goFixture is the Go program in testdata built by TestMain, with and without its symbol table.
+var goFixture struct {
+	path, strippedPath string
+	err                error
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "tiny-profiler-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	goFixture.path = filepath.Join(dir, "gofixture")
+	goFixture.strippedPath = filepath.Join(dir, "gofixture-stripped")
+	goFixture.err = buildGoFixture(goFixture.path)
+	if goFixture.err == nil {
+		goFixture.err = buildGoFixture(goFixture.strippedPath, "-ldflags=-s -w")
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func buildGoFixture(out string, flags ...string) error {
+	args := append([]string{"build", "-o", out}, flags...)
+	cmd := exec.Command("go", append(args, ".")...)
+	cmd.Dir = filepath.Join("testdata", "gofixture")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("build Go fixture: %w: %s", err, output)
+	}
+	return nil
+}
+
+// goFixtureTable reads the reference symbol table of the Go fixture using debug/gosym.
+func goFixtureTable(t *testing.T) *gosym.Table {
+	t.Helper()
+	if goFixture.err != nil {
+		t.Skip(goFixture.err)
+	}
+
+	f, err := elf.Open(goFixture.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pclntab, err := f.Section(".gopclntab").Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(pclntab, f.Section(".text").Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+// fixtureLine returns the line of the Go fixture source that ends with the given comment.
+func fixtureLine(t *testing.T, comment string) int {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "gofixture", "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if strings.HasSuffix(s.Text(), "// "+comment) {
+			return line
+		}
+	}
+	t.Fatalf("no line with comment %q", comment)
+	return 0
+}
+
+func TestGoSymbolsMatchGosym(t *testing.T) {
+	table := goFixtureTable(t)
+
+	for _, path := range []string{goFixture.path, goFixture.strippedPath} {
+		symbols, err := readGoSymbols(path)
+		if err != nil {
+			t.Fatalf("read pclntab of %s: %v", path, err)
+		}
+
+		checked := 0
+		for _, fn := range table.Funcs {
+			if !strings.HasPrefix(fn.Name, "main.") {
+				continue
+			}
+			for pc := fn.Entry; pc < fn.End; pc++ {
+				file, line, want := table.PCToLine(pc)
+				if want == nil {
+					continue
+				}
+				frames, ok := symbols.lookup(pc)
+				if !ok {
+					t.Fatalf("%s: no frames at %#x of %s", path, pc, fn.Name)
+				}
+				// debug/gosym gives the function the address is in, and the innermost source position.
+				outer, inner := frames[len(frames)-1], frames[0]
+				if file == "" {
+					// Padding between functions has no position.
+					file, line = inner.file, int(inner.line)
+				}
+				if outer.function != want.Name || inner.file != file || inner.line != int64(line) {
+					t.Fatalf("%s: got %s at %s:%d at %#x, want %s at %s:%d",
+						path, outer.function, inner.file, inner.line, pc, want.Name, file, line)
+				}
+				checked++
+			}
+		}
+		if checked == 0 {
+			t.Fatalf("%s: no main functions found", path)
+		}
+	}
+}
+
+func TestGoSymbolsInlinedFrames(t *testing.T) {
+	table := goFixtureTable(t)
+	inlinedLine := fixtureLine(t, "inlined")
+
+	compute := table.LookupFunc("main.compute")
+	if compute == nil {
+		t.Fatal("main.compute not found")
+	}
+	for _, path := range []string{goFixture.path, goFixture.strippedPath} {
+		symbols, err := readGoSymbols(path)
+		if err != nil {
+			t.Fatalf("read pclntab of %s: %v", path, err)
+		}
+
+		found := false
+		for pc := compute.Entry; pc < compute.End; pc++ {
+			if _, line, _ := table.PCToLine(pc); line != inlinedLine {
+				continue
+			}
+			frames, ok := symbols.lookup(pc)
+			if !ok {
+				t.Fatalf("%s: no frames at %#x", path, pc)
+			}
+			if len(frames) != 2 || frames[0].function != "main.add" || frames[1].function != "main.compute" {
+				t.Fatalf("%s: got frames %+v at %#x, want main.add inlined in main.compute", path, frames, pc)
+			}
+			found = true
+		}
+		if !found {
+			t.Fatalf("%s: main.add isn't inlined in main.compute", path)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package profiler
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mallocProgramName    = "malloc_enter"
+	callocProgramName    = "calloc_enter"
+	reallocProgramName   = "realloc_enter"
+	freeProgramName      = "free_enter"
+	allocExitProgramName = "alloc_exit"
+)
+
+// heapProgramNames are the programs of the heap profiler, they are only loaded when it is enabled.
+var heapProgramNames = []string{
+	mallocProgramName,
+	callocProgramName,
+	reallocProgramName,
+	freeProgramName,
+	allocExitProgramName,
+}
+
+// libcRegexp matches the file names of the C libraries that provide malloc, for glibc and musl.
+var libcRegexp = regexp.MustCompile(`^(?:libc(?:-[0-9.]+)?\.so(?:\.[0-9]+)*|ld-musl-[^/]+\.so\.1)$`)
+
+// allocatorProbe is a probe of a libc allocator function.
+type allocatorProbe struct {
+	symbol  string
+	program string
+	ret     bool
+}
+
+var allocatorProbes = []allocatorProbe{
+	{symbol: "malloc", program: mallocProgramName},
+	{symbol: "malloc", program: allocExitProgramName, ret: true},
+	{symbol: "calloc", program: callocProgramName},
+	{symbol: "calloc", program: allocExitProgramName, ret: true},
+	{symbol: "realloc", program: reallocProgramName},
+	{symbol: "realloc", program: allocExitProgramName, ret: true},
+	{symbol: "free", program: freeProgramName},
+}
+
+// heapProbes attaches the allocator probes to the C libraries the targeted processes use.
+type heapProbes struct {
+	logger  log.Logger
+	module  *bpf.Module
+	targets *targets
+
+	// attached holds the links of the libraries that are already probed, by probed PID, device and inode.
+	attached map[[3]uint64][]*bpf.BPFLink
+}
+
+func newHeapProbes(logger log.Logger, m *bpf.Module, t *targets) *heapProbes {
+	return &heapProbes{
+		logger:   logger,
+		module:   m,
+		targets:  t,
+		attached: map[[3]uint64][]*bpf.BPFLink{},
+	}
+}
+
+// attach probes the C libraries of processes that showed up since the last call,
+// and detaches the probes of the libraries no process maps anymore.
+// Outside of the pids target mode, a library is probed once for every process that maps it.
+func (h *heapProbes) attach() error {
+	pids, err := h.targets.candidatePIDs()
+	if err != nil {
+		return err
+	}
+	inUse := map[[3]uint64]struct{}{}
+	for _, pid := range pids {
+		libc, err := libcPath(pid)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				level.Debug(h.logger).Log("msg", "failed to find libc of process", "pid", pid, "err", err)
+			}
+			continue
+		}
+
+		probePID := h.targets.probePID(pid)
+		key, err := probeKey(probePID, libc)
+		if err != nil {
+			continue
+		}
+		inUse[key] = struct{}{}
+		if _, ok := h.attached[key]; ok {
+			continue
+		}
+
+		// Libraries that can't be probed are not retried.
+		links, err := h.attachLibrary(probePID, libc)
+		h.attached[key] = links
+		if err != nil {
+			level.Warn(h.logger).Log("msg", "failed to attach allocator probes", "path", libc, "err", err)
+			continue
+		}
+		level.Debug(h.logger).Log("msg", "attached allocator probes", "path", libc, "pid", probePID)
+	}
+	detachUnused(h.logger, h.attached, inUse)
+	return nil
+}
+
+// close detaches every allocator probe.
+func (h *heapProbes) close() {
+	for key, links := range h.attached {
+		detachProbes(h.logger, links)
+		delete(h.attached, key)
+	}
+}
+
+// attachLibrary probes the allocator functions of the given library, it returns the links of the
+// probes that were attached, even when attaching the others failed.
+func (h *heapProbes) attachLibrary(pid int, path string) ([]*bpf.BPFLink, error) {
+	offsets, err := symbolOffsets(path, []string{"malloc", "calloc", "realloc", "free"})
+	if err != nil {
+		return nil, err
+	}
+
+	var links []*bpf.BPFLink
+	for _, probe := range allocatorProbes {
+		offset, ok := offsets[probe.symbol]
+		if !ok {
+			return links, fmt.Errorf("symbol %s not found", probe.symbol)
+		}
+		prog, err := h.module.GetProgram(probe.program)
+		if err != nil {
+			return links, fmt.Errorf("get bpf program: %w", err)
+		}
+		var link *bpf.BPFLink
+		if probe.ret {
+			link, err = prog.AttachURetprobe(pid, path, uint32(offset))
+		} else {
+			link, err = prog.AttachUprobe(pid, path, uint32(offset))
+		}
+		if err != nil {
+			return links, fmt.Errorf("attach %s probe: %w", probe.symbol, err)
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// detachProbes destroys the given uprobe links.
+func detachProbes(logger log.Logger, links []*bpf.BPFLink) {
+	for _, link := range links {
+		if err := link.Destroy(); err != nil {
+			level.Debug(logger).Log("msg", "failed to detach probe", "err", err)
+		}
+	}
+}
+
+// detachUnused detaches and forgets the probes of the files that aren't in use anymore, by probe key,
+// e.g. because the probed process exited or every process using the file was restarted with another version.
+func detachUnused(logger log.Logger, attached map[[3]uint64][]*bpf.BPFLink, inUse map[[3]uint64]struct{}) {
+	for key, links := range attached {
+		if _, ok := inUse[key]; ok {
+			continue
+		}
+		detachProbes(logger, links)
+		delete(attached, key)
+	}
+}
+
+// probeKey identifies the file at the given path as probed for the given PID, -1 meaning every process.
+func probeKey(pid int, path string) ([3]uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return [3]uint64{}, err
+	}
+	return [3]uint64{uint64(pid), st.Dev, st.Ino}, nil
+}
+
+// libcPath returns the path of the C library mapped by the given process, as seen from the host.
+func libcPath(pid PID) (string, error) {
+	root := filepath.Join("/proc", fmt.Sprintf("%d", pid), "root")
+	f, err := os.Open(filepath.Join("/proc", fmt.Sprintf("%d", pid), "maps"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line looks like address perms offset dev inode pathname.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		path := fields[5]
+		if libcRegexp.MatchString(filepath.Base(path)) {
+			return filepath.Join(root, path), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no libc mapped: %w", os.ErrNotExist)
+}
+
+// symbolOffsets returns the file offsets of the given function symbols of an ELF file, which is where uprobes attach to.
+func symbolOffsets(path string, names []string) (map[string]uint64, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open elf file: %w", err)
+	}
+	defer f.Close()
+
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var syms []elf.Symbol
+	for _, read := range []func() ([]elf.Symbol, error){f.DynamicSymbols, f.Symbols} {
+		s, err := read()
+		if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+			return nil, fmt.Errorf("read symbols: %w", err)
+		}
+		syms = append(syms, s...)
+	}
+
+	offsets := map[string]uint64{}
+	for _, sym := range syms {
+		if !wanted[sym.Name] || elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 {
+			continue
+		}
+		if _, ok := offsets[sym.Name]; ok {
+			continue
+		}
+		for _, prog := range f.Progs {
+			if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+				continue
+			}
+			if sym.Value >= prog.Vaddr && sym.Value < prog.Vaddr+prog.Memsz {
+				offsets[sym.Name] = sym.Value - prog.Vaddr + prog.Off
+				break
+			}
+		}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,158 @@
+package profiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"golang.org/x/sys/unix"
+)
+
+const allocsMapName = "allocs"
+
+// heapSite is a stack the heap profiler saw allocations from.
+type heapSite struct {
+	// sample holds the stacks of the site, read in the profiling window its key was recorded in.
+	sample stackSample
+
+	// allocObjects and allocBytes are the allocations of the current profiling window.
+	allocObjects, allocBytes uint64
+	// inuseObjects and inuseBytes are the tracked allocations that weren't freed yet, whenever they were made.
+	inuseObjects, inuseBytes int64
+}
+
+// liveHeap keeps the memory held by the allocation sites across profiling windows. Allocations are counted with the
+// key of the window they are made in, and so are their frees in later windows, when the stacks the key refers to are
+// long gone. Sites are kept with their stacks for as long as they have live allocations.
+type liveHeap struct {
+	byteOrder binary.ByteOrder
+	// allocs holds the live allocations, whichever window they were made in.
+	allocs *bpf.BPFMap
+
+	sites map[stackCountKey]*heapSite
+}
+
+func newLiveHeap(m *bpf.Module, byteOrder binary.ByteOrder) (*liveHeap, error) {
+	allocs, err := m.GetMap(allocsMapName)
+	if err != nil {
+		return nil, fmt.Errorf("get allocs map: %w", err)
+	}
+	return &liveHeap{
+		byteOrder: byteOrder,
+		allocs:    allocs,
+		sites:     map[stackCountKey]*heapSite{},
+	}, nil
+}
+
+// forEachLiveHeapSample calls fn with the allocation sites of the targeted processes that allocated in the profiling
+// window or still have live allocations. The values of the samples are laid out like the allocation counters of the
+// counts map, with the in-use counters of the site instead of their changes.
+func (p *Profiler) forEachLiveHeapSample(pt profileType, isTarget func(PID) bool, fn func(*stackSample) error) error {
+	h := pt.liveHeap
+	err := p.forEachCount(pt, func(keyBytes, valueBytes []byte) error {
+		var key stackCountKey
+		if err := binary.Read(bytes.NewBuffer(keyBytes), h.byteOrder, &key); err != nil {
+			return fmt.Errorf("read stack count key: %w", err)
+		}
+		site, ok := h.sites[key]
+		if !ok {
+			// Frees of allocations whose site wasn't kept, e.g. because the process wasn't targeted, can't be attributed.
+			if key.Generation != pt.maps.generation || !isTarget(PID(key.PID)) {
+				return nil
+			}
+			site = &heapSite{sample: stackSample{key: key}}
+			if err := pt.maps.readStacks(&site.sample); err != nil {
+				return err
+			}
+			h.sites[key] = site
+		}
+		site.allocObjects += h.byteOrder.Uint64(valueBytes[0:8])
+		site.allocBytes += h.byteOrder.Uint64(valueBytes[8:16])
+		site.inuseObjects += int64(h.byteOrder.Uint64(valueBytes[16:24]))
+		site.inuseBytes += int64(h.byteOrder.Uint64(valueBytes[24:32]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	exited := map[PID]bool{}
+	for key, site := range h.sites {
+		pid := PID(key.PID)
+		if _, ok := exited[pid]; !ok {
+			exited[pid] = !processExists(pid)
+		}
+		// Allocations of exited processes are never freed.
+		if exited[pid] || !isTarget(pid) {
+			delete(h.sites, key)
+			continue
+		}
+
+		s := site.sample
+		s.valueBytes = make([]byte, 32)
+		h.byteOrder.PutUint64(s.valueBytes[0:8], site.allocObjects)
+		h.byteOrder.PutUint64(s.valueBytes[8:16], site.allocBytes)
+		// Allocations made while their window was read may be missed, their frees must not turn the site negative.
+		if site.inuseObjects > 0 && site.inuseBytes > 0 {
+			h.byteOrder.PutUint64(s.valueBytes[16:24], uint64(site.inuseObjects))
+			h.byteOrder.PutUint64(s.valueBytes[24:32], uint64(site.inuseBytes))
+			site.sample.reported = true
+			site.allocObjects, site.allocBytes = 0, 0
+		} else {
+			delete(h.sites, key)
+		}
+		if err := fn(&s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropExited deletes the live allocations of the processes that exited, which are never freed,
+// and returns the amount of live allocations left.
+func (h *liveHeap) dropExited() (int, error) {
+	var (
+		exited = map[PID]bool{}
+		stale  [][]byte
+		live   int
+	)
+	it := h.allocs.Iterator()
+	for it.Next() {
+		key := it.Key()
+		// The key is the address of the allocation followed by the PID.
+		pid := PID(h.byteOrder.Uint32(key[8:12]))
+		if _, ok := exited[pid]; !ok {
+			exited[pid] = !processExists(pid)
+		}
+		if !exited[pid] {
+			live++
+			continue
+		}
+		k := make([]byte, len(key))
+		copy(k, key)
+		stale = append(stale, k)
+	}
+	if it.Err() != nil {
+		return live, fmt.Errorf("iterate allocations: %w", it.Err())
+	}
+
+	for _, key := range stale {
+		// Allocations may have been freed in the meantime.
+		if err := h.allocs.DeleteKey(unsafe.Pointer(&key[0])); err != nil && !errors.Is(err, unix.ENOENT) {
+			return live, fmt.Errorf("delete allocation: %w", err)
+		}
+	}
+	return live, nil
+}
+
+// processExists reports whether the given process is still running.
+func processExists(pid PID) bool {
+	_, err := os.Stat(filepath.Join("/proc", strconv.FormatUint(uint64(pid), 10)))
+	return err == nil
+}
@@ -0,0 +1,282 @@
+package profiler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	burrow "github.com/goburrow/cache"
+	"github.com/google/pprof/profile"
+	"github.com/parca-dev/parca-agent/pkg/perf"
+)
+
+const (
+	jitdumpMagic = 0x4A695444 // JiTD
+
+	jitCodeLoad = 0
+	jitCodeMove = 1
+
+	maxJitdumpRecordSize = 16 << 20
+
+	// jitdumpCacheSize bounds the processes whose jitdump symbols are kept, the symbols of processes
+	// that weren't symbolized for jitdumpTTL, e.g. because they exited, expire.
+	jitdumpCacheSize = 64
+	jitdumpTTL       = 10 * time.Minute
+)
+
+// jitdumpRegexp matches the file names of jitdump files, runtimes map them to announce them to perf.
+var jitdumpRegexp = regexp.MustCompile(`^jit-[0-9]+\.dump$`)
+
+// JITSymbolizer resolves the user locations of just-in-time compiled code, e.g. of Node.js or the JVM.
+// The code lives in anonymous executable mappings, its symbols are read from the perf map file
+// /tmp/perf-<pid>.map and from the jitdump file of the process, both through its mount namespace.
+type JITSymbolizer struct {
+	logger    log.Logger
+	perfCache *perf.Cache
+
+	// jitdumps caches the symbols read from jitdump files, by PID.
+	jitdumps burrow.Cache
+}
+
+// jitdump are the symbols of a jitdump file, which only grows while the process runs.
+type jitdump struct {
+	path    string
+	size    int64
+	symbols elfSymbols
+}
+
+func NewJITSymbolizer(logger log.Logger) *JITSymbolizer {
+	return &JITSymbolizer{
+		logger:    logger,
+		perfCache: perf.NewPerfCache(logger),
+		jitdumps: burrow.New(
+			burrow.WithMaximumSize(jitdumpCacheSize),
+			burrow.WithExpireAfterAccess(jitdumpTTL),
+		),
+	}
+}
+
+func (s *JITSymbolizer) Symbolize(_ context.Context, _ []*profile.Location, userLocations map[uint32][]*profile.Location) ([]*profile.Function, error) {
+	var (
+		functions     []*profile.Function
+		functionsByID = map[[2]string]*profile.Function{}
+	)
+	for pid, locations := range userLocations {
+		var (
+			perfMap  *perf.Map
+			dump     elfSymbols
+			resolved bool
+		)
+		for _, loc := range locations {
+			if len(loc.Line) > 0 || loc.Mapping != nil && loc.Mapping.File != "" {
+				continue
+			}
+			// Symbols are only read for processes with JIT frames.
+			if !resolved {
+				resolved = true
+				perfMap, dump = s.symbols(pid)
+			}
+
+			name, source := "", ""
+			if perfMap != nil {
+				if sym, err := perfMap.Lookup(loc.Address); err == nil {
+					name, source = sym, "perf-map"
+				}
+			}
+			if name == "" {
+				if sym, ok := dump.lookup(loc.Address); ok {
+					name, source = sym, "jitdump"
+				}
+			}
+			if name == "" {
+				continue
+			}
+
+			key := [2]string{source, name}
+			f, ok := functionsByID[key]
+			if !ok {
+				f = &profile.Function{Name: name, SystemName: name}
+				functionsByID[key] = f
+				functions = append(functions, f)
+			}
+			loc.Line = []profile.Line{{Function: f}}
+			if loc.Mapping != nil {
+				loc.Mapping.HasFunctions = true
+			}
+		}
+	}
+	return functions, nil
+}
+
+// symbols returns the perf map and the jitdump symbols of the given process, either may be missing.
+func (s *JITSymbolizer) symbols(pid uint32) (*perf.Map, elfSymbols) {
+	perfMap, err := s.perfCache.CacheForPID(pid)
+	if err != nil && !errors.Is(err, perf.ErrNotFound) {
+		level.Debug(s.logger).Log("msg", "failed to read perf map", "pid", pid, "err", err)
+	}
+
+	dump, err := s.jitdump(pid)
+	if err != nil {
+		level.Debug(s.logger).Log("msg", "failed to read jitdump", "pid", pid, "err", err)
+	}
+	return perfMap, dump
+}
+
+// jitdump returns the symbols of the jitdump file the given process mapped, if any.
+func (s *JITSymbolizer) jitdump(pid uint32) (elfSymbols, error) {
+	path, err := jitdumpPath(pid)
+	if err != nil || path == "" {
+		s.jitdumps.Invalidate(pid)
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if val, ok := s.jitdumps.GetIfPresent(pid); ok {
+		if d := val.(*jitdump); d.path == path && d.size == info.Size() {
+			return d.symbols, nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	symbols, err := readJitdump(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	s.jitdumps.Put(pid, &jitdump{path: path, size: info.Size(), symbols: symbols})
+	return symbols, nil
+}
+
+// jitdumpPath returns the path of the jitdump file mapped by the given process, as seen from the host.
+func jitdumpPath(pid uint32) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", fmt.Sprintf("%d", pid), "maps"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// Each line looks like address perms offset dev inode pathname.
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		if jitdumpRegexp.MatchString(filepath.Base(fields[5])) {
+			return filepath.Join("/proc", fmt.Sprintf("%d", pid), "root", fields[5]), nil
+		}
+	}
+	return "", nil
+}
+
+// readJitdump reads the code load and move records of a jitdump file,
+// see tools/perf/Documentation/jitdump-specification.txt of the Linux sources.
+func readJitdump(r io.Reader) (elfSymbols, error) {
+	var header struct {
+		Magic     uint32
+		Version   uint32
+		TotalSize uint32
+		ElfMach   uint32
+		Pad1      uint32
+		PID       uint32
+		Timestamp uint64
+		Flags     uint64
+	}
+	raw := make([]byte, binary.Size(header))
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	// The magic tells the byte order of the file.
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if binary.BigEndian.Uint32(raw) == jitdumpMagic {
+		byteOrder = binary.BigEndian
+	}
+	if err := binary.Read(bytes.NewReader(raw), byteOrder, &header); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if header.Magic != jitdumpMagic {
+		return nil, fmt.Errorf("invalid jitdump magic %#x", header.Magic)
+	}
+	// The header may grow in later versions.
+	headerSize := uint32(binary.Size(header))
+	if header.TotalSize > headerSize {
+		if _, err := io.CopyN(io.Discard, r, int64(header.TotalSize-headerSize)); err != nil {
+			return nil, fmt.Errorf("read header: %w", err)
+		}
+	}
+
+	// Code may be unloaded and its address reused, the last record of an address wins.
+	byStart := map[uint64]elfSymbol{}
+	for {
+		var record struct {
+			ID        uint32
+			TotalSize uint32
+			Timestamp uint64
+		}
+		if err := binary.Read(r, byteOrder, &record); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// The last record may still be being written.
+				break
+			}
+			return nil, fmt.Errorf("read record: %w", err)
+		}
+		recordSize := uint32(binary.Size(record))
+		// The file is written by the profiled process, don't trust it with huge records.
+		if record.TotalSize < recordSize || record.TotalSize > maxJitdumpRecordSize {
+			return nil, fmt.Errorf("invalid record size %d", record.TotalSize)
+		}
+		body := make([]byte, record.TotalSize-recordSize)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+
+		switch record.ID {
+		case jitCodeLoad:
+			// pid, tid, vma, code address, code size, code index, name and code.
+			if len(body) < 40 {
+				continue
+			}
+			addr := byteOrder.Uint64(body[16:])
+			size := byteOrder.Uint64(body[24:])
+			name := body[40:]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			byStart[addr] = elfSymbol{start: addr, end: addr + size, name: string(name)}
+		case jitCodeMove:
+			// pid, tid, vma, old code address, new code address, code size and code index.
+			if len(body) < 40 {
+				continue
+			}
+			oldAddr := byteOrder.Uint64(body[16:])
+			newAddr := byteOrder.Uint64(body[24:])
+			size := byteOrder.Uint64(body[32:])
+			if sym, ok := byStart[oldAddr]; ok {
+				delete(byStart, oldAddr)
+				byStart[newAddr] = elfSymbol{start: newAddr, end: newAddr + size, name: sym.name}
+			}
+		}
+	}
+
+	symbols := make(elfSymbols, 0, len(byStart))
+	for _, sym := range byStart {
+		symbols = append(symbols, sym)
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].start < symbols[j].start })
+	return symbols, nil
+}
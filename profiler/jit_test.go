@@ -0,0 +1,108 @@
+package profiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// jitdumpBuilder writes jitdump files the way runtimes do, in the given byte order.
+type jitdumpBuilder struct {
+	order binary.ByteOrder
+	buf   bytes.Buffer
+}
+
+func (b *jitdumpBuilder) write(values ...interface{}) {
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			b.buf.WriteString(s)
+			b.buf.WriteByte(0)
+			continue
+		}
+		binary.Write(&b.buf, b.order, v)
+	}
+}
+
+// header writes a file header with padding that later versions may add.
+func (b *jitdumpBuilder) header(padding int) {
+	const headerSize = 40
+	b.write(uint32(jitdumpMagic), uint32(1), uint32(headerSize+padding), uint32(62), uint32(0), uint32(42), uint64(1), uint64(0))
+	b.buf.Write(make([]byte, padding))
+}
+
+// record writes a record of the given ID with a body of the given values and size.
+func (b *jitdumpBuilder) record(id uint32, size int, body ...interface{}) {
+	b.write(id, uint32(16+size), uint64(2))
+	b.write(body...)
+}
+
+func (b *jitdumpBuilder) codeLoad(addr, size uint64, name string) {
+	code := make([]byte, size)
+	b.record(jitCodeLoad, 40+len(name)+1+len(code), uint32(42), uint32(43), addr, addr, size, uint64(0), name, code)
+}
+
+func (b *jitdumpBuilder) codeMove(oldAddr, newAddr, size uint64) {
+	b.record(jitCodeMove, 48, uint32(42), uint32(43), newAddr, oldAddr, newAddr, size, uint64(0))
+}
+
+func TestReadJitdump(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			b := &jitdumpBuilder{order: order}
+			b.header(8)
+			b.codeLoad(0x1000, 0x100, "foo")
+			b.codeLoad(0x2000, 0x80, "bar")
+			b.codeMove(0x2000, 0x3000, 0x80)
+			// Moves of unknown code and other records, here debug info, are skipped.
+			b.codeMove(0x4000, 0x5000, 0x10)
+			b.record(2, 8, uint64(0x1000))
+			// Code unloaded and loaded again at the same address replaces the previous one.
+			b.codeLoad(0x1000, 0x40, "foo2")
+			// The last record is still being written.
+			b.record(jitCodeLoad, 40+4+0x100, uint32(42), uint32(43), uint64(0x6000), uint64(0x6000))
+
+			got, err := readJitdump(&b.buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := elfSymbols{
+				{start: 0x1000, end: 0x1040, name: "foo2"},
+				{start: 0x3000, end: 0x3080, name: "bar"},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got symbols %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadJitdumpTruncatedRecordHeader(t *testing.T) {
+	b := &jitdumpBuilder{order: binary.LittleEndian}
+	b.header(0)
+	b.codeLoad(0x1000, 0x10, "foo")
+	b.write(uint32(jitCodeLoad), uint32(100))
+
+	got, err := readJitdump(&b.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (elfSymbols{{start: 0x1000, end: 0x1010, name: "foo"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got symbols %+v, want %+v", got, want)
+	}
+}
+
+func TestReadJitdumpInvalid(t *testing.T) {
+	b := &jitdumpBuilder{order: binary.LittleEndian}
+	b.write(uint32(0x12345678), uint32(1), uint32(40), uint32(62), uint32(0), uint32(42), uint64(1), uint64(0))
+	if _, err := readJitdump(&b.buf); err == nil {
+		t.Error("got no error for an invalid magic")
+	}
+
+	b = &jitdumpBuilder{order: binary.LittleEndian}
+	b.header(0)
+	b.write(uint32(jitCodeLoad), uint32(maxJitdumpRecordSize+1), uint64(2))
+	if _, err := readJitdump(&b.buf); err == nil {
+		t.Error("got no error for a huge record")
+	}
+}
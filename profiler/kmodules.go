@@ -0,0 +1,120 @@
+package profiler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+const (
+	kernelMappingFile = "[kernel.kallsyms]"
+	procModulesPath   = "/proc/modules"
+)
+
+// kernelModule is the memory range of a loaded kernel module.
+type kernelModule struct {
+	name       string
+	start, end uint64
+}
+
+// readKernelModules returns the loaded kernel modules sorted by address.
+// Modules are left out when their address is hidden, which is the case without CAP_SYSLOG.
+func readKernelModules() ([]kernelModule, error) {
+	f, err := os.Open(procModulesPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// The kernel is built without module support.
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var modules []kernelModule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line looks like name size refcount dependencies state address.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		size, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		start, err := strconv.ParseUint(strings.TrimPrefix(fields[5], "0x"), 16, 64)
+		if err != nil || start == 0 {
+			continue
+		}
+		modules = append(modules, kernelModule{name: fields[0], start: start, end: start + size})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", procModulesPath, err)
+	}
+	sort.Slice(modules, func(i, j int) bool { return modules[i].start < modules[j].start })
+	return modules, nil
+}
+
+// kernelModulesFingerprint identifies the set of loaded modules, it changes when modules are loaded or unloaded.
+func kernelModulesFingerprint(modules []kernelModule) string {
+	var b strings.Builder
+	for _, m := range modules {
+		fmt.Fprintf(&b, "%s %x\n", m.name, m.start)
+	}
+	return b.String()
+}
+
+// kernelMappings assigns kernel addresses to the mapping of the core kernel or of the module they belong to.
+type kernelMappings struct {
+	modules []kernelModule
+
+	kernel   *profile.Mapping
+	byModule map[string]*profile.Mapping
+	// mappings are the mappings addresses were assigned to, in order of use.
+	mappings []*profile.Mapping
+}
+
+func newKernelMappings(modules []kernelModule) *kernelMappings {
+	return &kernelMappings{
+		modules:  modules,
+		byModule: map[string]*profile.Mapping{},
+	}
+}
+
+// mapping returns the mapping of the given kernel address.
+func (k *kernelMappings) mapping(addr uint64) *profile.Mapping {
+	i := sort.Search(len(k.modules), func(i int) bool { return k.modules[i].start > addr }) - 1
+	if i >= 0 && addr < k.modules[i].end {
+		module := k.modules[i]
+		m, ok := k.byModule[module.name]
+		if !ok {
+			m = &profile.Mapping{
+				Start: module.start,
+				Limit: module.end,
+				File:  kernelModuleLabel(module.name),
+			}
+			k.byModule[module.name] = m
+			k.mappings = append(k.mappings, m)
+		}
+		return m
+	}
+
+	if k.kernel == nil {
+		k.kernel = &profile.Mapping{
+			File: kernelMappingFile,
+		}
+		k.mappings = append(k.mappings, k.kernel)
+	}
+	return k.kernel
+}
+
+// kernelModuleLabel returns the label of the frames of a kernel module, e.g. [ext4].
+func kernelModuleLabel(name string) string {
+	return "[" + name + "]"
+}
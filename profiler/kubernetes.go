@@ -0,0 +1,321 @@
+package profiler
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	burrow "github.com/goburrow/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	criv1 "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// podMetadataRefreshInterval limits how often the pod source is queried for containers it doesn't know about.
+	podMetadataRefreshInterval = 10 * time.Second
+
+	criTimeout = 2 * time.Second
+	// criContainersCacheSize bounds the pod metadata of containers kept by the CRI provider,
+	// the metadata of containers that aren't profiled anymore expires after criContainerTTL.
+	criContainersCacheSize = 1024
+	criContainerTTL        = 10 * time.Minute
+)
+
+var errPodNotFound = errors.New("pod not found")
+
+// PodMetadata describes the Kubernetes pod and container a process runs in.
+type PodMetadata struct {
+	Name      string
+	Namespace string
+	Container string
+	Labels    map[string]string
+}
+
+// PodMetadataProvider resolves container IDs to the pods they belong to.
+type PodMetadataProvider interface {
+	PodMetadata(ctx context.Context, containerID string) (*PodMetadata, error)
+}
+
+// KubeletPodProvider resolves pod metadata using the pod list served by the kubelet /pods endpoint.
+type KubeletPodProvider struct {
+	url    string
+	token  string
+	client *http.Client
+
+	mtx         *sync.Mutex
+	containers  map[string]*PodMetadata
+	lastRefresh time.Time
+}
+
+// NewKubeletPodProvider creates a provider that queries the kubelet at the given URL, e.g. https://localhost:10250.
+// The bearer token is optional.
+func NewKubeletPodProvider(url, token string, insecureSkipVerify bool) *KubeletPodProvider {
+	return &KubeletPodProvider{
+		url:   strings.TrimSuffix(url, "/"),
+		token: token,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				//nolint:gosec
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+			},
+		},
+		mtx:        &sync.Mutex{},
+		containers: map[string]*PodMetadata{},
+	}
+}
+
+// kubeletPodList is the subset of the v1.PodList the kubelet serves that the profiler needs.
+type kubeletPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Status struct {
+			ContainerStatuses          []kubeletContainerStatus `json:"containerStatuses"`
+			InitContainerStatuses      []kubeletContainerStatus `json:"initContainerStatuses"`
+			EphemeralContainerStatuses []kubeletContainerStatus `json:"ephemeralContainerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type kubeletContainerStatus struct {
+	Name string `json:"name"`
+	// ContainerID has the form <runtime>://<id>.
+	ContainerID string `json:"containerID"`
+}
+
+func (k *KubeletPodProvider) PodMetadata(ctx context.Context, containerID string) (*PodMetadata, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	if pod, ok := k.containers[containerID]; ok {
+		return pod, nil
+	}
+	if time.Since(k.lastRefresh) < podMetadataRefreshInterval {
+		return nil, errPodNotFound
+	}
+
+	if err := k.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if pod, ok := k.containers[containerID]; ok {
+		return pod, nil
+	}
+	return nil, errPodNotFound
+}
+
+// refresh replaces the cached containers with the pods the kubelet currently runs.
+func (k *KubeletPodProvider) refresh(ctx context.Context) error {
+	k.lastRefresh = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url+"/pods", nil)
+	if err != nil {
+		return err
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("list kubelet pods: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("list kubelet pods: unexpected status %s", resp.Status)
+	}
+
+	var pods kubeletPodList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return fmt.Errorf("decode kubelet pods: %w", err)
+	}
+
+	containers := map[string]*PodMetadata{}
+	for _, pod := range pods.Items {
+		statuses := append(append(append([]kubeletContainerStatus{},
+			pod.Status.ContainerStatuses...),
+			pod.Status.InitContainerStatuses...),
+			pod.Status.EphemeralContainerStatuses...)
+		for _, status := range statuses {
+			i := strings.Index(status.ContainerID, "://")
+			if i < 0 {
+				continue
+			}
+			containers[status.ContainerID[i+len("://"):]] = &PodMetadata{
+				Name:      pod.Metadata.Name,
+				Namespace: pod.Metadata.Namespace,
+				Container: status.Name,
+				Labels:    pod.Metadata.Labels,
+			}
+		}
+	}
+	k.containers = containers
+	return nil
+}
+
+// CRIPodProvider resolves pod metadata by asking the container runtime through its CRI socket.
+type CRIPodProvider struct {
+	conn   *grpc.ClientConn
+	client criv1.RuntimeServiceClient
+
+	mtx        *sync.Mutex
+	containers burrow.Cache
+	// misses holds the containers the runtime didn't know about in the last refresh interval.
+	misses burrow.Cache
+}
+
+// NewCRIPodProvider connects to the CRI runtime service listening on the given unix socket,
+// e.g. /run/containerd/containerd.sock or /var/run/crio/crio.sock.
+func NewCRIPodProvider(socketPath string) (*CRIPodProvider, error) {
+	conn, err := grpc.Dial(
+		socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dial CRI socket %s: %w", socketPath, err)
+	}
+
+	return &CRIPodProvider{
+		conn:   conn,
+		client: criv1.NewRuntimeServiceClient(conn),
+		mtx:    &sync.Mutex{},
+		containers: burrow.New(
+			burrow.WithMaximumSize(criContainersCacheSize),
+			burrow.WithExpireAfterAccess(criContainerTTL),
+		),
+		misses: burrow.New(
+			burrow.WithMaximumSize(criContainersCacheSize),
+			burrow.WithExpireAfterWrite(podMetadataRefreshInterval),
+		),
+	}, nil
+}
+
+func (c *CRIPodProvider) Close() error {
+	c.containers.Close()
+	c.misses.Close()
+	return c.conn.Close()
+}
+
+func (c *CRIPodProvider) PodMetadata(ctx context.Context, containerID string) (*PodMetadata, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if val, ok := c.containers.GetIfPresent(containerID); ok {
+		//nolint:forcetypeassert
+		return val.(*PodMetadata), nil
+	}
+	if _, ok := c.misses.GetIfPresent(containerID); ok {
+		return nil, errPodNotFound
+	}
+
+	pod, err := c.lookup(ctx, containerID)
+	if err != nil {
+		c.misses.Put(containerID, struct{}{})
+		return nil, err
+	}
+	c.misses.Invalidate(containerID)
+	c.containers.Put(containerID, pod)
+	return pod, nil
+}
+
+func (c *CRIPodProvider) lookup(ctx context.Context, containerID string) (*PodMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, criTimeout)
+	defer cancel()
+
+	containers, err := c.client.ListContainers(ctx, &criv1.ListContainersRequest{
+		Filter: &criv1.ContainerFilter{Id: containerID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list CRI containers: %w", err)
+	}
+	if len(containers.Containers) == 0 {
+		return nil, errPodNotFound
+	}
+	container := containers.Containers[0]
+
+	sandboxes, err := c.client.ListPodSandbox(ctx, &criv1.ListPodSandboxRequest{
+		Filter: &criv1.PodSandboxFilter{Id: container.PodSandboxId},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list CRI pod sandboxes: %w", err)
+	}
+	if len(sandboxes.Items) == 0 || sandboxes.Items[0].Metadata == nil {
+		return nil, errPodNotFound
+	}
+	sandbox := sandboxes.Items[0]
+
+	pod := &PodMetadata{
+		Name:      sandbox.Metadata.Name,
+		Namespace: sandbox.Metadata.Namespace,
+		Labels:    sandbox.Labels,
+	}
+	if container.Metadata != nil {
+		pod.Container = container.Metadata.Name
+	}
+	return pod, nil
+}
+
+var invalidLabelCharRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// podLabels returns the Kubernetes labels of the given process, if it runs in a pod.
+func (p *Profiler) podLabels(ctx context.Context, pid PID) map[string]string {
+	labels := map[string]string{}
+	if p.podMetadataProvider == nil {
+		return labels
+	}
+
+	cgroupPath, err := procCgroupPath(pid)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Debug(p.logger).Log("msg", "failed to read cgroup of process", "pid", pid, "err", err)
+		}
+		return labels
+	}
+	return p.cgroupPodLabels(ctx, cgroupPath)
+}
+
+// cgroupPodLabels returns the Kubernetes labels of the container of the given cgroup, if it runs in a pod.
+func (p *Profiler) cgroupPodLabels(ctx context.Context, cgroupPath string) map[string]string {
+	labels := map[string]string{}
+	id, ok := containerID(cgroupPath)
+	if !ok {
+		return labels
+	}
+
+	pod, err := p.podMetadataProvider.PodMetadata(ctx, id)
+	if err != nil {
+		if !errors.Is(err, errPodNotFound) {
+			level.Debug(p.logger).Log("msg", "failed to get pod metadata", "container_id", id, "err", err)
+		}
+		return labels
+	}
+
+	labels["pod"] = pod.Name
+	labels["namespace"] = pod.Namespace
+	labels["container"] = pod.Container
+	for _, key := range p.podLabelKeys {
+		if value, ok := pod.Labels[key]; ok {
+			labels["pod_label_"+invalidLabelCharRegexp.ReplaceAllString(key, "_")] = value
+		}
+	}
+	return labels
+}
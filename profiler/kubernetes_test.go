@@ -0,0 +1,223 @@
+package profiler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+const (
+	apiContainerID     = "14c2529eb4498c5d1ffd6915d05bf58a91bdda796af59f41d480d11c099d0479"
+	sidecarContainerID = "6c8b4535ccc87f19061c4646189e33d78f01c8b63dc4e3cb2f630b1796ee93b6"
+	migrateContainerID = "3bc801a33ea83df414e1aeb962a52412835be99db28668ec25de73fdd4733804"
+	unknownContainerID = "b9c1e4fbd0ed0ba9bd1e9a8c0cc6f4e5b8f3ba0c0b0c1c4c6e7d2f2e3a6e1d9c"
+)
+
+const kubeletPodsResponse = `{
+  "items": [
+    {
+      "metadata": {"name": "api-7d4b9", "namespace": "prod", "labels": {"app": "api", "app.kubernetes.io/name": "api-server", "team": "core"}},
+      "status": {
+        "containerStatuses": [
+          {"name": "api", "containerID": "containerd://` + apiContainerID + `"},
+          {"name": "sidecar", "containerID": "cri-o://` + sidecarContainerID + `"}
+        ],
+        "initContainerStatuses": [
+          {"name": "migrate", "containerID": "docker://` + migrateContainerID + `"}
+        ]
+      }
+    },
+    {
+      "metadata": {"name": "pending-0", "namespace": "prod"},
+      "status": {
+        "containerStatuses": [
+          {"name": "waiting", "containerID": ""}
+        ]
+      }
+    }
+  ]
+}`
+
+// newFakeKubelet serves the pods of kubeletPodsResponse and counts the requests.
+func newFakeKubelet(t *testing.T, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("got authorization %q, want bearer token", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(kubeletPodsResponse))
+	}))
+}
+
+func TestKubeletPodProvider(t *testing.T) {
+	var requests int32
+	srv := newFakeKubelet(t, &requests)
+	defer srv.Close()
+
+	k := NewKubeletPodProvider(srv.URL+"/", "secret", false)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		containerID string
+		want        *PodMetadata
+	}{
+		{
+			containerID: apiContainerID,
+			want: &PodMetadata{
+				Name:      "api-7d4b9",
+				Namespace: "prod",
+				Container: "api",
+				Labels:    map[string]string{"app": "api", "app.kubernetes.io/name": "api-server", "team": "core"},
+			},
+		},
+		{
+			containerID: sidecarContainerID,
+			want: &PodMetadata{
+				Name:      "api-7d4b9",
+				Namespace: "prod",
+				Container: "sidecar",
+				Labels:    map[string]string{"app": "api", "app.kubernetes.io/name": "api-server", "team": "core"},
+			},
+		},
+		{
+			containerID: migrateContainerID,
+			want: &PodMetadata{
+				Name:      "api-7d4b9",
+				Namespace: "prod",
+				Container: "migrate",
+				Labels:    map[string]string{"app": "api", "app.kubernetes.io/name": "api-server", "team": "core"},
+			},
+		},
+	} {
+		got, err := k.PodMetadata(ctx, tc.containerID)
+		if err != nil {
+			t.Fatalf("pod metadata of %s: %v", tc.containerID, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("pod metadata of %s: got %+v, want %+v", tc.containerID, got, tc.want)
+		}
+	}
+
+	// The runtime prefix isn't part of the container ID.
+	if _, err := k.PodMetadata(ctx, "containerd://"+apiContainerID); !errors.Is(err, errPodNotFound) {
+		t.Errorf("got %v for a prefixed container ID, want %v", err, errPodNotFound)
+	}
+	// Unknown containers don't query the kubelet again before the refresh interval.
+	if _, err := k.PodMetadata(ctx, unknownContainerID); !errors.Is(err, errPodNotFound) {
+		t.Errorf("got %v for an unknown container, want %v", err, errPodNotFound)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("got %d kubelet requests, want 1", n)
+	}
+}
+
+func TestKubeletPodProviderError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	k := NewKubeletPodProvider(srv.URL, "", false)
+	_, err := k.PodMetadata(context.Background(), apiContainerID)
+	if err == nil || errors.Is(err, errPodNotFound) {
+		t.Fatalf("got %v, want the kubelet error", err)
+	}
+}
+
+func TestPodLabels(t *testing.T) {
+	var requests int32
+	srv := newFakeKubelet(t, &requests)
+	defer srv.Close()
+
+	k := NewKubeletPodProvider(srv.URL, "secret", false)
+	p := NewProfiler(log.NewNopLogger(), "test", 10*time.Second,
+		WithPodMetadataProvider(k, []string{"app", "app.kubernetes.io/name", "missing"}))
+	ctx := context.Background()
+
+	apiLabels := map[string]string{
+		"pod":                              "api-7d4b9",
+		"namespace":                        "prod",
+		"container":                        "api",
+		"pod_label_app":                    "api",
+		"pod_label_app_kubernetes_io_name": "api-server",
+	}
+	for _, tc := range []struct {
+		name string
+		// cgroup is the content of /proc/<pid>/cgroup.
+		cgroup string
+		want   map[string]string
+	}{
+		{
+			name:   "containerd systemd driver",
+			cgroup: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod5f2c.slice/cri-containerd-" + apiContainerID + ".scope\n",
+			want:   apiLabels,
+		},
+		{
+			name: "containerd cgroupfs driver on cgroup v1",
+			cgroup: "12:cpu,cpuacct:/kubepods/besteffort/pod5f2c/" + apiContainerID + "\n" +
+				"1:name=systemd:/kubepods/besteffort/pod5f2c/" + apiContainerID + "\n" +
+				"0::/\n",
+			want: apiLabels,
+		},
+		{
+			name:   "cri-o",
+			cgroup: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod5f2c.slice/crio-" + sidecarContainerID + ".scope\n",
+			want: map[string]string{
+				"pod":                              "api-7d4b9",
+				"namespace":                        "prod",
+				"container":                        "sidecar",
+				"pod_label_app":                    "api",
+				"pod_label_app_kubernetes_io_name": "api-server",
+			},
+		},
+		{
+			name:   "docker",
+			cgroup: "0::/system.slice/docker-" + migrateContainerID + ".scope\n",
+			want: map[string]string{
+				"pod":                              "api-7d4b9",
+				"namespace":                        "prod",
+				"container":                        "migrate",
+				"pod_label_app":                    "api",
+				"pod_label_app_kubernetes_io_name": "api-server",
+			},
+		},
+		{
+			name:   "cri-o conmon",
+			cgroup: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod5f2c.slice/crio-conmon-" + sidecarContainerID + ".scope\n",
+			want:   map[string]string{},
+		},
+		{
+			name:   "unknown container",
+			cgroup: "0::/system.slice/docker-" + unknownContainerID + ".scope\n",
+			want:   map[string]string{},
+		},
+		{
+			name:   "host process",
+			cgroup: "0::/user.slice/user-1000.slice/session-2.scope\n",
+			want:   map[string]string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cgroupPath, err := parseCgroupPath(strings.NewReader(tc.cgroup))
+			if err != nil {
+				t.Fatalf("parse cgroup path: %v", err)
+			}
+			if got := p.cgroupPodLabels(ctx, cgroupPath); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got labels %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -5,102 +5,421 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"syscall"
 	"unsafe"
 
 	bpf "github.com/aquasecurity/libbpfgo"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	countsMapName      = "counts"
-	stackTracesMapName = "stack_traces"
+	generationConfigMapName = "generation_config"
+
+	// Names of the maps that come in two generations, without the generation suffix.
+	countsMapName       = "counts"
+	stackTracesMapName  = "stack_traces"
+	offCPUCountsMapName = "offcpu_counts"
+	// offCPUStackTracesMapName holds the stacks off-CPU samples are recorded with, they are stored when tasks
+	// wake up, whichever generation they blocked in.
+	offCPUStackTracesMapName = "offcpu_stack_traces"
+	allocCountsMapName       = "alloc_counts"
+	goAllocCountsMapName     = "go_alloc_counts"
 )
 
+// generationMapName returns the name of the map of the given generation, e.g. counts_1.
+func generationMapName(name string, generation int) string {
+	return fmt.Sprintf("%s_%d", name, generation)
+}
+
+// mapGenerations are the two sets of maps samples are recorded in. The BPF programs record samples in the
+// current generation, while the profiler reads and cleans the other one, so samples recorded in the meantime
+// aren't lost.
+type mapGenerations struct {
+	byteOrder binary.ByteOrder
+	config    *bpf.BPFMap
+
+	// current counts up with every profiling window, its lowest bit selects the maps.
+	current     uint32
+	generations [2]*bpfMaps
+}
+
+// newMapGenerations returns the maps of both generations of a loaded module.
+func newMapGenerations(m *bpf.Module, byteOrder binary.ByteOrder) (*mapGenerations, error) {
+	config, err := m.GetMap(generationConfigMapName)
+	if err != nil {
+		return nil, fmt.Errorf("get generation config map: %w", err)
+	}
+	g := &mapGenerations{
+		byteOrder: byteOrder,
+		config:    config,
+	}
+	for generation := range g.generations {
+		maps, err := newBPFMaps(m, byteOrder, generation)
+		if err != nil {
+			return nil, fmt.Errorf("get maps of generation %d: %w", generation, err)
+		}
+		g.generations[generation] = maps
+	}
+	return g, nil
+}
+
+// switchGeneration makes the BPF programs record samples in the other generation,
+// it returns the maps of the generation recorded in so far.
+func (g *mapGenerations) switchGeneration() (*bpfMaps, error) {
+	next := g.current + 1
+	zero := uint32(0)
+	value := make([]byte, 4)
+	g.byteOrder.PutUint32(value, next)
+	if err := g.config.Update(unsafe.Pointer(&zero), unsafe.Pointer(&value[0])); err != nil {
+		return nil, fmt.Errorf("update generation config: %w", err)
+	}
+
+	previous := g.generations[g.current&1]
+	previous.generation = g.current
+	g.current = next
+	return previous, nil
+}
+
+// bpfMaps are the maps of a generation.
 type bpfMaps struct {
 	byteOrder binary.ByteOrder
+	// generation is the generation the maps were last recorded in, the keys of the samples recorded then have it.
+	generation uint32
+
+	counts            *bpf.BPFMap
+	stackTraces       *bpf.BPFMap
+	dwarfStackTraces  *bpf.BPFMap
+	offCPUCounts      *bpf.BPFMap
+	offCPUStackTraces *bpf.BPFMap
+	allocCounts       *bpf.BPFMap
+	goAllocCounts     *bpf.BPFMap
+
+	// batch is whether the kernel supports batch operations on a map, by map, it's probed on first use.
+	batch map[*bpf.BPFMap]bool
+	// deleted counts the entries deleted from each map since the occupancy was last taken.
+	deleted map[*bpf.BPFMap]int
+}
+
+// newBPFMaps returns the maps of the given generation of a loaded module.
+func newBPFMaps(m *bpf.Module, byteOrder binary.ByteOrder, generation int) (*bpfMaps, error) {
+	maps := &bpfMaps{byteOrder: byteOrder, batch: map[*bpf.BPFMap]bool{}, deleted: map[*bpf.BPFMap]int{}}
+	for name, bpfMap := range map[string]**bpf.BPFMap{
+		countsMapName:            &maps.counts,
+		stackTracesMapName:       &maps.stackTraces,
+		dwarfStackTracesMapName:  &maps.dwarfStackTraces,
+		offCPUCountsMapName:      &maps.offCPUCounts,
+		offCPUStackTracesMapName: &maps.offCPUStackTraces,
+		allocCountsMapName:       &maps.allocCounts,
+		goAllocCountsMapName:     &maps.goAllocCounts,
+	} {
+		var err error
+		if *bpfMap, err = m.GetMap(generationMapName(name, generation)); err != nil {
+			return nil, fmt.Errorf("get %s map: %w", name, err)
+		}
+	}
+	return maps, nil
+}
+
+// all returns the maps of the generation.
+func (m *bpfMaps) all() []*bpf.BPFMap {
+	return []*bpf.BPFMap{m.counts, m.stackTraces, m.dwarfStackTraces, m.offCPUCounts, m.offCPUStackTraces, m.allocCounts, m.goAllocCounts}
+}
+
+// takeOccupancy returns the amount of entries each map of the generation held at the end of its profiling window,
+// once the generation is cleaned, and starts counting anew. Every entry is deleted once, either while the samples
+// are read or while the generation is cleaned, so counting the deleted entries spares walking the maps again.
+func (m *bpfMaps) takeOccupancy() map[*bpf.BPFMap]int {
+	occupancy := map[*bpf.BPFMap]int{}
+	for _, bpfMap := range m.all() {
+		occupancy[bpfMap] = m.deleted[bpfMap]
+	}
+	m.deleted = map[*bpf.BPFMap]int{}
+	return occupancy
+}
+
+// Reasons stack walks fail for, they label the stack walk failure metric.
+const (
+	stackFailureZeroID  = "zero_id"
+	stackFailureFault   = "efault"
+	stackFailureExists  = "eexist"
+	stackFailureMapFull = "map_full"
+	stackFailureLookup  = "lookup"
+	stackFailureUnknown = "unknown"
+)
+
+// errNoStack is returned for samples that don't have the requested stack, which isn't a failure,
+// e.g. kernel threads have no user stack and samples taken in user space have no kernel stack.
+var errNoStack = errors.New("no stack")
+
+// stackWalkError is returned when a stack couldn't be walked or read.
+type stackWalkError struct {
+	reason string
+	err    error
+}
+
+func (e *stackWalkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stackWalkError) Unwrap() error {
+	return e.err
+}
+
+// stackIDError returns the error of a stack ID that doesn't refer to a stack trace, if any.
+// Failed walks keep the negative error of bpf_get_stackid as their ID.
+func stackIDError(stack string, stackID int32) error {
+	if stackID > 0 {
+		return nil
+	}
+	if stackID == 0 {
+		return &stackWalkError{
+			reason: stackFailureZeroID,
+			err:    fmt.Errorf("%s stack ID is 0, probably stack unwinding failed", stack),
+		}
+	}
+
+	errno := syscall.Errno(-stackID)
+	reason := stackFailureUnknown
+	switch errno {
+	case unix.EFAULT:
+		// Nothing could be walked, e.g. the first frame isn't readable.
+		reason = stackFailureFault
+	case unix.EEXIST:
+		// Another stack with the same hash is already stored.
+		reason = stackFailureExists
+	case unix.ENOMEM:
+		// Every stack trace slot is taken.
+		reason = stackFailureMapFull
+	}
+	return &stackWalkError{reason: reason, err: fmt.Errorf("walk %s stack: %w", stack, errno)}
+}
+
+// kernelStackIDError is stackIDError for kernel stacks. Kernel stacks aren't walked for user space probes,
+// and there is nothing to walk for samples taken in user space, bpf_get_stackid fails with EFAULT then.
+func kernelStackIDError(stackID int32) error {
+	if stackID == 0 || stackID == -int32(unix.EFAULT) {
+		return errNoStack
+	}
+	return stackIDError("kernel", stackID)
+}
 
-	counts      *bpf.BPFMap
-	stackTraces *bpf.BPFMap
+// readStacks reads the stacks of the key of the given sample into it, and tells why either stack is missing.
+// Only errors that can't be recovered from are returned.
+func (m *bpfMaps) readStacks(s *stackSample) error {
+	userStackTraces, kernelStackTraces := m.stackTraces, m.stackTraces
+	switch {
+	case s.key.OffCPUStacks != 0:
+		userStackTraces, kernelStackTraces = m.offCPUStackTraces, m.offCPUStackTraces
+	case s.key.UserStackDWARF != 0:
+		// Stacks walked using unwind tables are stored by the BPF program.
+		userStackTraces = m.dwarfStackTraces
+	}
+
+	s.userErr = errNoStack
+	if s.key.KernelThread == 0 {
+		s.userErr = m.readUserStack(s.key.UserStackID, userStackTraces, &s.stack)
+		if errors.Is(s.userErr, errUnrecoverable) {
+			return s.userErr
+		}
+	}
+	s.kernelErr = m.readKernelStack(s.key.KernelStackID, kernelStackTraces, &s.stack)
+	if errors.Is(s.kernelErr, errUnrecoverable) {
+		return s.kernelErr
+	}
+	return nil
 }
 
-// readUserStack reads the user stack trace from the stacktraces ebpf map into the given buffer.
-func (m *bpfMaps) readUserStack(userStackID int32, stack *combinedStack) error {
-	if userStackID == 0 {
-		return errors.New("user stack ID is 0, probably stack unwinding failed")
+// readUserStack reads the user stack trace from the given stack traces ebpf map into the given buffer.
+func (m *bpfMaps) readUserStack(userStackID int32, stackTraces *bpf.BPFMap, stack *combinedStack) error {
+	if err := stackIDError("user", userStackID); err != nil {
+		return err
 	}
 
-	stackBytes, err := m.stackTraces.GetValue(unsafe.Pointer(&userStackID))
+	stackBytes, err := stackTraces.GetValue(unsafe.Pointer(&userStackID))
 	if err != nil {
-		return fmt.Errorf("read user stack trace: %w", err)
+		return &stackWalkError{reason: stackFailureLookup, err: fmt.Errorf("read user stack trace: %w", err)}
 	}
 
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[:stackDepth]); err != nil {
+	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[:stackFrames(stackBytes)]); err != nil {
 		return fmt.Errorf("read user stack bytes, %s: %w", err, errUnrecoverable)
 	}
 
 	return nil
 }
 
-// readKernelStack reads the kernel stack trace from the stacktraces ebpf map into the given buffer.
-func (m *bpfMaps) readKernelStack(kernelStackID int32, stack *combinedStack) error {
-	if kernelStackID == 0 {
-		return errors.New("kernel stack ID is 0, probably stack unwinding failed")
+// readKernelStack reads the kernel stack trace from the given stack traces ebpf map into the given buffer.
+func (m *bpfMaps) readKernelStack(kernelStackID int32, stackTraces *bpf.BPFMap, stack *combinedStack) error {
+	if err := kernelStackIDError(kernelStackID); err != nil {
+		return err
 	}
 
-	stackBytes, err := m.stackTraces.GetValue(unsafe.Pointer(&kernelStackID))
+	stackBytes, err := stackTraces.GetValue(unsafe.Pointer(&kernelStackID))
 	if err != nil {
-		return fmt.Errorf("read kernel stack trace: %w", err)
+		return &stackWalkError{reason: stackFailureLookup, err: fmt.Errorf("read kernel stack trace: %w", err)}
 	}
 
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[stackDepth:]); err != nil {
+	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[stackDepth:stackDepth+stackFrames(stackBytes)]); err != nil {
 		return fmt.Errorf("read kernel stack bytes, %s: %w", err, errUnrecoverable)
 	}
 
 	return nil
 }
 
-// readStackCount reads the value of the given key from the counts ebpf map.
-func (m *bpfMaps) readStackCount(keyBytes []byte) (uint64, error) {
-	valueBytes, err := m.counts.GetValue(unsafe.Pointer(&keyBytes[0]))
+// stackFrames returns the amount of frames of the given stack trace map value,
+// which holds as many frames as the configured max stack depth.
+func stackFrames(stackBytes []byte) int {
+	frames := len(stackBytes) / 8
+	if frames > stackDepth {
+		return stackDepth
+	}
+	return frames
+}
+
+// readStackCount reads the raw value of the given key from the given counts ebpf map.
+func (m *bpfMaps) readStackCount(counts *bpf.BPFMap, keyBytes []byte) ([]byte, error) {
+	valueBytes, err := counts.GetValue(unsafe.Pointer(&keyBytes[0]))
 	if err != nil {
-		return 0, fmt.Errorf("get count value: %w", err)
+		return nil, fmt.Errorf("get count value: %w", err)
 	}
-	return m.byteOrder.Uint64(valueBytes), nil
+	return valueBytes, nil
 }
 
 func (m *bpfMaps) clean() error {
-	// BPF iterators need the previous value to iterate to the next, so we
-	// can only delete the "previous" item once we've already iterated to
-	// the next.
+	if err := m.cleanMap(m.stackTraces); err != nil {
+		return fmt.Errorf("failed to clean stack traces: %w", err)
+	}
+	if err := m.cleanMap(m.dwarfStackTraces); err != nil {
+		return fmt.Errorf("failed to clean DWARF stack traces: %w", err)
+	}
+	if err := m.cleanMap(m.counts); err != nil {
+		return fmt.Errorf("failed to clean counts: %w", err)
+	}
+	if err := m.cleanMap(m.offCPUCounts); err != nil {
+		return fmt.Errorf("failed to clean off-CPU counts: %w", err)
+	}
+	if err := m.cleanMap(m.offCPUStackTraces); err != nil {
+		return fmt.Errorf("failed to clean off-CPU stack traces: %w", err)
+	}
+	if err := m.cleanMap(m.allocCounts); err != nil {
+		return fmt.Errorf("failed to clean allocation counts: %w", err)
+	}
+	if err := m.cleanMap(m.goAllocCounts); err != nil {
+		return fmt.Errorf("failed to clean Go allocation counts: %w", err)
+	}
+	return nil
+}
 
-	it := m.stackTraces.Iterator()
-	var prev []byte = nil
-	for it.Next() {
-		if prev != nil {
-			err := m.stackTraces.DeleteKey(unsafe.Pointer(&prev[0]))
-			if err != nil {
-				return fmt.Errorf("failed to delete stack trace: %w", err)
-			}
-		}
+// cleanMap deletes every key of the given ebpf map, in batches where the kernel supports it.
+func (m *bpfMaps) cleanMap(bpfMap *bpf.BPFMap) error {
+	drained, err := m.lookupAndDeleteAll(bpfMap, nil)
+	if err != nil || drained {
+		return err
+	}
+	deleted, err := deleteKeys(bpfMap)
+	m.deleted[bpfMap] += deleted
+	return err
+}
 
-		key := it.Key()
-		prev = make([]byte, len(key))
-		copy(prev, key)
+// lookupAndDeleteAll calls fn, when given, with the raw keys and values of the given hash map and deletes them,
+// with as few BPF_MAP_LOOKUP_AND_DELETE_BATCH commands as possible. It returns false and leaves the map untouched
+// when the kernel doesn't support batch operations on the map. Entries fn fails for are deleted all the same,
+// the first error is returned once the map is drained.
+func (m *bpfMaps) lookupAndDeleteAll(bpfMap *bpf.BPFMap, fn func(keyBytes, valueBytes []byte) error) (bool, error) {
+	supported, ok := m.batch[bpfMap]
+	if !ok {
+		var err error
+		if supported, err = batchSupported(bpfMap); err != nil {
+			return false, err
+		}
+		m.batch[bpfMap] = supported
 	}
-	if prev != nil {
-		err := m.stackTraces.DeleteKey(unsafe.Pointer(&prev[0]))
+	if !supported {
+		return false, nil
+	}
+
+	// A batch of the size of the whole map never splits a hash bucket, which the kernel refuses.
+	count := bpfMap.GetMaxEntries()
+	keySize := bpfMap.KeySize()
+	keys := make([]byte, keySize*int(count))
+	startKey := make([]byte, keySize)
+	nextKey := make([]byte, keySize)
+	var (
+		start    unsafe.Pointer
+		firstErr error
+		failed   int
+	)
+	for {
+		values, err := bpfMap.GetValueAndDeleteBatch(unsafe.Pointer(&keys[0]), start, unsafe.Pointer(&nextKey[0]), count)
 		if err != nil {
-			return fmt.Errorf("failed to delete stack trace: %w", err)
+			return true, fmt.Errorf("lookup and delete batch: %w", err)
+		}
+		m.deleted[bpfMap] += len(values)
+		if fn != nil {
+			for i, valueBytes := range values {
+				if err := fn(keys[i*keySize:(i+1)*keySize], valueBytes); err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					failed++
+				}
+			}
+		}
+		// A partial batch means there is nothing left.
+		if len(values) < int(count) {
+			break
 		}
+		copy(startKey, nextKey)
+		start = unsafe.Pointer(&startKey[0])
 	}
+	if failed > 1 {
+		return true, fmt.Errorf("%w, and %d more entries failed", firstErr, failed-1)
+	}
+	return true, firstErr
+}
+
+// errENOTSUPP is the error of batch operations a map type doesn't implement,
+// the kernel doesn't expose it to user space headers.
+const errENOTSUPP = syscall.Errno(524)
+
+// batchSupported reports whether the kernel supports batch operations on the given map, they need Linux 5.6
+// and a map type that implements them, e.g. not stack trace maps. It asks for an empty batch, which the kernel
+// answers before touching the map.
+func batchSupported(bpfMap *bpf.BPFMap) (bool, error) {
+	// bpf_attr of the batch commands.
+	attr := struct {
+		inBatch, outBatch uint64
+		keys, values      uint64
+		count, mapFD      uint32
+		elemFlags, flags  uint64
+	}{mapFD: uint32(bpfMap.GetFd())}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_MAP_LOOKUP_AND_DELETE_BATCH, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	switch errno {
+	case 0:
+		return true, nil
+	case unix.EINVAL, unix.EOPNOTSUPP, errENOTSUPP:
+		// Older kernels don't know the command.
+		return false, nil
+	default:
+		return false, fmt.Errorf("probe batch operations of map %s: %w", bpfMap.Name(), errno)
+	}
+}
 
-	it = m.counts.Iterator()
-	prev = nil
+// deleteKeys deletes every key of the given ebpf map one by one, it returns the amount of deleted keys.
+func deleteKeys(bpfMap *bpf.BPFMap) (int, error) {
+	// BPF iterators need the previous value to iterate to the next, so we
+	// can only delete the "previous" item once we've already iterated to
+	// the next.
+
+	it := bpfMap.Iterator()
+	var prev []byte = nil
+	deleted := 0
 	for it.Next() {
 		if prev != nil {
-			err := m.counts.DeleteKey(unsafe.Pointer(&prev[0]))
+			err := bpfMap.DeleteKey(unsafe.Pointer(&prev[0]))
 			if err != nil {
-				return fmt.Errorf("failed to delete count: %w", err)
+				return deleted, fmt.Errorf("failed to delete key: %w", err)
 			}
+			deleted++
 		}
 
 		key := it.Key()
@@ -108,11 +427,12 @@ func (m *bpfMaps) clean() error {
 		copy(prev, key)
 	}
 	if prev != nil {
-		err := m.counts.DeleteKey(unsafe.Pointer(&prev[0]))
+		err := bpfMap.DeleteKey(unsafe.Pointer(&prev[0]))
 		if err != nil {
-			return fmt.Errorf("failed to delete count: %w", err)
+			return deleted, fmt.Errorf("failed to delete key: %w", err)
 		}
+		deleted++
 	}
 
-	return nil
+	return deleted, nil
 }
@@ -0,0 +1,119 @@
+package profiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
+	"github.com/parca-dev/parca-agent/pkg/byteorder"
+)
+
+// benchmarkCountsEntries is the amount of entries the counts map is filled with before it's drained.
+const benchmarkCountsEntries = 4096
+
+// loadCountsMap loads the maps of the BPF object, without its programs, and returns the counts map of the
+// first generation. It skips the benchmark when the maps can't be created, e.g. without the needed privileges.
+func loadCountsMap(b *testing.B) *bpf.BPFMap {
+	b.Helper()
+
+	m, err := bpf.NewModuleFromBufferArgs(bpf.NewModuleArgs{
+		BPFObjBuff: bpfObj,
+		BPFObjName: "tiny-profiler",
+	})
+	if err != nil {
+		b.Skipf("new bpf module: %v", err)
+	}
+	b.Cleanup(m.Close)
+
+	it := m.Iterator()
+	for prog := it.NextProgram(); prog != nil; prog = it.NextProgram() {
+		if err := prog.SetAutoload(false); err != nil {
+			b.Fatalf("disable %s program: %v", prog.GetName(), err)
+		}
+	}
+	if err := (&Profiler{logger: log.NewNopLogger()}).bumpMemlockRlimit(); err != nil {
+		b.Skipf("bump memlock rlimit: %v", err)
+	}
+	if err := m.BPFLoadObject(); err != nil {
+		b.Skipf("load bpf object: %v", err)
+	}
+
+	counts, err := m.GetMap(generationMapName(countsMapName, 0))
+	if err != nil {
+		b.Fatalf("get counts map: %v", err)
+	}
+	return counts
+}
+
+// fillCounts adds the given amount of entries to the given counts map, with distinct tasks.
+func fillCounts(b *testing.B, counts *bpf.BPFMap, entries int) {
+	b.Helper()
+
+	byteOrder := byteorder.GetHostByteOrder()
+	value := make([]byte, 8)
+	byteOrder.PutUint64(value, 1)
+	for i := 0; i < entries; i++ {
+		var key bytes.Buffer
+		if err := binary.Write(&key, byteOrder, stackCountKey{PID: uint32(i + 1), TID: uint32(i + 1)}); err != nil {
+			b.Fatal(err)
+		}
+		if err := counts.Update(unsafe.Pointer(&key.Bytes()[0]), unsafe.Pointer(&value[0])); err != nil {
+			b.Fatalf("update counts map: %v", err)
+		}
+	}
+}
+
+// benchmarkDrainCounts reads and cleans a filled counts map the way the profiler does at the end of every
+// profiling window, in batches or key by key.
+func benchmarkDrainCounts(b *testing.B, batch bool) {
+	counts := loadCountsMap(b)
+	if batch {
+		if supported, err := batchSupported(counts); err != nil || !supported {
+			b.Skipf("batch operations aren't supported: %v", err)
+		}
+	}
+	p := &Profiler{logger: log.NewNopLogger(), byteOrder: byteorder.GetHostByteOrder()}
+	maps := &bpfMaps{
+		byteOrder: p.byteOrder,
+		counts:    counts,
+		batch:     map[*bpf.BPFMap]bool{counts: batch},
+		deleted:   map[*bpf.BPFMap]int{},
+	}
+	pt := profileType{counts: counts, maps: maps}
+	isTarget := func(PID) bool { return true }
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fillCounts(b, counts, benchmarkCountsEntries)
+		b.StartTimer()
+
+		entries := 0
+		err := p.forEachCountedSample(pt, isTarget, func(*stackSample) error {
+			entries++
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := maps.cleanMap(counts); err != nil {
+			b.Fatal(err)
+		}
+		if entries != benchmarkCountsEntries {
+			b.Fatalf("read %d entries, want %d", entries, benchmarkCountsEntries)
+		}
+	}
+}
+
+func BenchmarkLookupAndDeleteAll(b *testing.B) {
+	benchmarkDrainCounts(b, true)
+}
+
+// BenchmarkDeleteKeys is the fallback of kernels without batch operations, iterating the keys, looking up their
+// values and deleting them once read.
+func BenchmarkDeleteKeys(b *testing.B) {
+	benchmarkDrainCounts(b, false)
+}
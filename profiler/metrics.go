@@ -0,0 +1,182 @@
+package profiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type metrics struct {
+	// stackWalkFailures counts the samples whose user or kernel stack is missing, by reason.
+	stackWalkFailures *prometheus.CounterVec
+	// streamedSamplesDropped counts the streamed samples that weren't aggregated, by reason.
+	streamedSamplesDropped *prometheus.CounterVec
+}
+
+// newMetrics creates the metrics of the profiler, they aren't registered when the registerer is nil.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	return &metrics{
+		stackWalkFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "tiny_profiler_stack_walk_failures_total",
+			Help: "Total number of sampled stacks that couldn't be walked or read, by stack and reason.",
+		}, []string{"stack", "reason"}),
+		streamedSamplesDropped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "tiny_profiler_streamed_samples_dropped_total",
+			Help: "Total number of streamed samples that were dropped, because the buffer was full or the memory limit was reached.",
+		}, []string{"reason"}),
+	}
+}
+
+const (
+	statsMapName     = "stats"
+	possibleCPUsPath = "/sys/devices/system/cpu/possible"
+)
+
+// statReasons label the statistics the BPF programs keep, by index in the stats map,
+// same as STAT_* in the BPF program.
+var statReasons = []string{
+	"counts_full",
+	"stack_traces_full",
+	"stack_collision",
+	"filtered",
+	"alloc_stale",
+}
+
+// bpfCollector exports the statistics the BPF programs keep in the stats map, read when the metrics are scraped,
+// and the occupancy of the maps samples are recorded in, recorded once per profiling window.
+type bpfCollector struct {
+	byteOrder binary.ByteOrder
+	stats     *bpf.BPFMap
+	cpus      int
+	maps      []*bpf.BPFMap
+
+	entriesMtx *sync.Mutex
+	// entries is the amount of entries each map held at the end of the last profiling window of its generation.
+	entries map[*bpf.BPFMap]int
+
+	skippedDesc    *prometheus.Desc
+	entriesDesc    *prometheus.Desc
+	maxEntriesDesc *prometheus.Desc
+}
+
+func newBPFCollector(m *bpf.Module, byteOrder binary.ByteOrder, generations *mapGenerations) (*bpfCollector, error) {
+	stats, err := m.GetMap(statsMapName)
+	if err != nil {
+		return nil, fmt.Errorf("get stats map: %w", err)
+	}
+	cpus, err := possibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+	allocs, err := m.GetMap(allocsMapName)
+	if err != nil {
+		return nil, fmt.Errorf("get allocs map: %w", err)
+	}
+	var maps []*bpf.BPFMap
+	for _, generation := range generations.generations {
+		maps = append(maps, generation.all()...)
+	}
+	// Live allocations outlast the profiling windows, the map isn't part of a generation.
+	maps = append(maps, allocs)
+	return &bpfCollector{
+		byteOrder: byteOrder,
+		stats:     stats,
+		cpus:      cpus,
+		maps:      maps,
+
+		entriesMtx: &sync.Mutex{},
+		entries:    map[*bpf.BPFMap]int{},
+		skippedDesc: prometheus.NewDesc(
+			"tiny_profiler_bpf_samples_skipped_total",
+			"Total number of samples or stacks the BPF programs didn't record, because a map was full, the stack collided with another one, the task of a CPU sample was filtered out, or an allocation returned after its profiling window ended.",
+			[]string{"reason"}, nil,
+		),
+		entriesDesc: prometheus.NewDesc(
+			"tiny_profiler_bpf_map_entries",
+			"Number of entries of the maps samples are recorded in, at the end of the last profiling window of their generation.",
+			[]string{"map"}, nil,
+		),
+		maxEntriesDesc: prometheus.NewDesc(
+			"tiny_profiler_bpf_map_max_entries",
+			"Max number of entries of the maps samples are recorded in.",
+			[]string{"map"}, nil,
+		),
+	}, nil
+}
+
+func (c *bpfCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.skippedDesc
+	ch <- c.entriesDesc
+	ch <- c.maxEntriesDesc
+}
+
+func (c *bpfCollector) Collect(ch chan<- prometheus.Metric) {
+	// Per-CPU values are read for every possible CPU at once.
+	value := make([]byte, 8*c.cpus)
+	for i, reason := range statReasons {
+		stat := uint32(i)
+		if err := c.stats.GetValueReadInto(unsafe.Pointer(&stat), &value); err != nil {
+			ch <- prometheus.NewInvalidMetric(c.skippedDesc, fmt.Errorf("read %s stat: %w", reason, err))
+			continue
+		}
+		var total uint64
+		for cpu := 0; cpu < c.cpus; cpu++ {
+			total += c.byteOrder.Uint64(value[cpu*8:])
+		}
+		ch <- prometheus.MustNewConstMetric(c.skippedDesc, prometheus.CounterValue, float64(total), reason)
+	}
+
+	c.entriesMtx.Lock()
+	defer c.entriesMtx.Unlock()
+	for _, bpfMap := range c.maps {
+		// Maps of a generation that wasn't read yet have no occupancy.
+		if entries, ok := c.entries[bpfMap]; ok {
+			ch <- prometheus.MustNewConstMetric(c.entriesDesc, prometheus.GaugeValue, float64(entries), bpfMap.Name())
+		}
+		ch <- prometheus.MustNewConstMetric(c.maxEntriesDesc, prometheus.GaugeValue, float64(bpfMap.GetMaxEntries()), bpfMap.Name())
+	}
+}
+
+// setOccupancy records the amount of entries the maps of a generation held at the end of its profiling window.
+func (c *bpfCollector) setOccupancy(occupancy map[*bpf.BPFMap]int) {
+	c.entriesMtx.Lock()
+	defer c.entriesMtx.Unlock()
+
+	for bpfMap, entries := range occupancy {
+		c.entries[bpfMap] = entries
+	}
+}
+
+// possibleCPUs returns the number of CPUs the kernel may bring online, per-CPU maps have a value for each of them.
+func possibleCPUs() (int, error) {
+	data, err := os.ReadFile(possibleCPUsPath)
+	if err != nil {
+		return 0, fmt.Errorf("read possible CPUs: %w", err)
+	}
+	// The file lists ranges of CPU IDs, e.g. 0-3,5.
+	cpus := 0
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		first, last, found := strings.Cut(r, "-")
+		if !found {
+			last = first
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return 0, fmt.Errorf("parse possible CPUs %q: %w", data, err)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil {
+			return 0, fmt.Errorf("parse possible CPUs %q: %w", data, err)
+		}
+		cpus += to - from + 1
+	}
+	return cpus, nil
+}
@@ -2,6 +2,8 @@ package profiler
 
 import (
 	"github.com/parca-dev/parca-agent/pkg/debuginfo"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Option func(p *Profiler)
@@ -12,8 +14,134 @@ func WithDebugInfoUploader(d *debuginfo.DebugInfo) Option {
 	}
 }
 
+// WithRegisterer registers the metrics of the profiler, e.g. the stack walk failures.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(p *Profiler) {
+		p.reg = reg
+	}
+}
+
+// WithObjectFileCache sets the cache object files are opened through, to share it with the symbolizer
+// so that every object file is opened and parsed once.
+func WithObjectFileCache(c objectfile.Cache) Option {
+	return func(p *Profiler) {
+		p.objFileCache = c
+	}
+}
+
 func WithProfileWriter(w ProfileWriter) Option {
 	return func(p *Profiler) {
 		p.profileWriter = w
 	}
 }
+
+// WithSymbolizer selects how the functions of the profiles are resolved on the node.
+func WithSymbolizer(s Symbolizer) Option {
+	return func(p *Profiler) {
+		p.symbolizer = s
+	}
+}
+
+// WithDemangling selects how C++ and Rust function names are demangled.
+func WithDemangling(mode DemangleMode) Option {
+	return func(p *Profiler) {
+		p.demangleMode = mode
+	}
+}
+
+func WithTargets(mode TargetMode, pids []int) Option {
+	return func(p *Profiler) {
+		p.targets = newTargets(mode, pids)
+	}
+}
+
+func WithFilter(f Filter) Option {
+	return func(p *Profiler) {
+		p.filter = f
+	}
+}
+
+// WithPodMetadataProvider enables Kubernetes pod labels, the given pod label keys are attached as pod_label_<key>.
+func WithPodMetadataProvider(provider PodMetadataProvider, labelKeys []string) Option {
+	return func(p *Profiler) {
+		p.podMetadataProvider = provider
+		p.podLabelKeys = labelKeys
+	}
+}
+
+// WithSamplingFrequency sets the frequency in Hz stacks are sampled at, which must be greater than zero.
+// The kernel may allow less than that, see kernel.perf_event_max_sample_rate.
+func WithSamplingFrequency(hz uint64) Option {
+	return func(p *Profiler) {
+		p.samplingFrequency = hz
+	}
+}
+
+// WithMaxStackDepth sets the depth stacks are walked to, up to 127 frames.
+// Kernel and user stacks reaching it each get a synthetic [truncated] frame where they were cut.
+func WithMaxStackDepth(depth int) Option {
+	return func(p *Profiler) {
+		p.maxStackDepth = depth
+	}
+}
+
+// WithSampleStreaming streams CPU samples with their stacks through a BPF ring buffer, or a perf buffer
+// on kernels without ring buffers, instead of counting them in a BPF map. The aggregated samples take up
+// to the given amount of bytes, samples of new stacks are dropped beyond that.
+func WithSampleStreaming(enabled bool, memoryLimit uint64) Option {
+	return func(p *Profiler) {
+		p.sampleStreaming = enabled
+		p.sampleStreamMemoryLimit = memoryLimit
+	}
+}
+
+// WithOffCPUProfiling enables the off-CPU profiler, which records the time tasks spend blocked.
+// Tasks that block in a profiling window and wake up in a later one aren't recorded, as their stacks are gone.
+func WithOffCPUProfiling(enabled bool) Option {
+	return func(p *Profiler) {
+		p.offCPU = enabled
+	}
+}
+
+// WithPerfEvent selects the perf event stacks are sampled on.
+// Events other than cpu-clock are sampled every period events, a zero period uses the default of the event.
+// cpu-clock is sampled at the sampling frequency instead, so it takes no period.
+func WithPerfEvent(event PerfEvent, period uint64) Option {
+	return func(p *Profiler) {
+		p.perfEvent = event
+		p.perfEventPeriod = period
+	}
+}
+
+// WithHeapProfiling enables the heap profiler, which traces the libc allocator of the targeted processes.
+// Besides the allocations of every profiling window, it records the in-use memory, allocated in any window
+// and not freed yet.
+func WithHeapProfiling(enabled bool) Option {
+	return func(p *Profiler) {
+		p.heap = enabled
+	}
+}
+
+// WithGoAllocProfiling enables the Go allocation profiler, which traces runtime.mallocgc of the targeted Go binaries.
+func WithGoAllocProfiling(enabled bool) Option {
+	return func(p *Profiler) {
+		p.goAlloc = enabled
+	}
+}
+
+// WithDWARFUnwinding enables walking the user stacks of processes built without frame pointers
+// using the call frame information of their binaries. Only x86_64 is supported.
+func WithDWARFUnwinding(enabled bool) Option {
+	return func(p *Profiler) {
+		p.dwarfUnwinding = enabled
+	}
+}
+
+// WithBTF loads the BPF object with the given BTF file, for kernels that don't expose their own BTF.
+// Without a file, the BTF of the running kernel release is looked up in the archive directory on such kernels.
+func WithBTF(path, archiveDir string) Option {
+	return func(p *Profiler) {
+		p.btfPath = path
+		p.btfArchiveDir = archiveDir
+	}
+}
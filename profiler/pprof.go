@@ -61,21 +61,14 @@ func (rw *RemoteProfileWriter) Write(ctx context.Context, labels map[string]stri
 	return err
 }
 
-func (p *Profiler) pprofProfile(pr *Profile) (*profile.Profile, error) {
+func (p *Profiler) pprofProfile(ctx context.Context, pr *Profile) (*profile.Profile, error) {
 	prof := &profile.Profile{
-		SampleType: []*profile.ValueType{{
-			Type: "samples",
-			Unit: "count",
-		}},
+		SampleType:    pr.profileType.sampleTypes,
 		TimeNanos:     pr.captureTime.UnixNano(),
 		DurationNanos: int64(time.Since(pr.captureTime)),
 
-		// We sample at 100Hz, which is every 10 Million nanoseconds.
-		PeriodType: &profile.ValueType{
-			Type: "cpu",
-			Unit: "nanoseconds",
-		},
-		Period: 10000000,
+		PeriodType: pr.profileType.periodType,
+		Period:     pr.profileType.period,
 	}
 
 	// Build Profile from samples, locations and mappings.
@@ -89,19 +82,26 @@ func (p *Profiler) pprofProfile(pr *Profile) (*profile.Profile, error) {
 	// User mappings.
 	prof.Mapping = pr.userMappings
 
-	// Kernel mappings.
-	pr.kernelMapping.ID = uint64(len(prof.Mapping)) + 1
-	prof.Mapping = append(prof.Mapping, pr.kernelMapping)
+	// Kernel mappings, of the core kernel and of the modules.
+	for _, m := range pr.kernelMappings {
+		m.ID = uint64(len(prof.Mapping)) + 1
+		prof.Mapping = append(prof.Mapping, m)
+	}
+
+	for _, f := range pr.syntheticFunctions {
+		f.ID = uint64(len(prof.Function)) + 1
+		prof.Function = append(prof.Function, f)
+	}
 
-	// TODO(kakkoyun): Better to separate symbolization from pprof conversion.
-	kernelFunctions, err := p.resolveKernelFunctions(pr.kernelLocations)
+	functions, err := p.symbolizer.Symbolize(ctx, pr.kernelLocations, pr.userLocations)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve kernel functions: %w", err)
+		return nil, fmt.Errorf("failed to resolve functions: %w", err)
 	}
-	for _, f := range kernelFunctions {
+	for _, f := range functions {
 		f.ID = uint64(len(prof.Function)) + 1
 		prof.Function = append(prof.Function, f)
 	}
+	demangleFunctions(p.demangleMode, prof.Function)
 
 	return prof, nil
 }
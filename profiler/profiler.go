@@ -9,24 +9,24 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"os"
 	"runtime"
-	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
-	"unsafe"
 
 	bpf "github.com/aquasecurity/libbpfgo"
 	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/google/gops/goprocess"
 	"github.com/google/pprof/profile"
 	"github.com/parca-dev/parca-agent/pkg/byteorder"
 	"github.com/parca-dev/parca-agent/pkg/debuginfo"
-	"github.com/parca-dev/parca-agent/pkg/ksym"
 	"github.com/parca-dev/parca-agent/pkg/maps"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sys/unix"
 )
 
@@ -34,12 +34,22 @@ import (
 var bpfObj []byte
 
 const (
-	stackDepth       = 127 // Always needs to be sync with MAX_STACK_DEPTH in BPF program.
+	stackDepth       = 127 // Max stack depth, always needs to be sync with MAX_STACK_DEPTH in BPF program.
 	doubleStackDepth = stackDepth * 2
 
+	// truncatedFunctionName names the synthetic frame marking where kernel or user stacks hit the stack depth.
+	truncatedFunctionName = "[truncated]"
+	// unknownUserStackFunctionName names the synthetic frame standing for user stacks that couldn't be walked.
+	unknownUserStackFunctionName = "[unknown user stack]"
+
 	defaultRLimit = 1024 << 20 // ~1GB
 
-	programName = "profile_cpu"
+	defaultSamplingFrequency   = 100 // Hz
+	perfEventMaxSampleRatePath = "/proc/sys/kernel/perf_event_max_sample_rate"
+
+	programName             = "profile_cpu"
+	offCPUSwitchProgramName = "offcpu_sched_switch"
+	offCPUWakeupProgramName = "offcpu_sched_wakeup"
 )
 
 var errUnrecoverable = errors.New("unrecoverable error")
@@ -53,8 +63,50 @@ type Profiler struct {
 	logger            log.Logger
 	profilingDuration time.Duration
 
-	byteOrder binary.ByteOrder
-	bpfMaps   *bpfMaps
+	// samplingFrequency is the requested frequency, the kernel may allow less than that.
+	samplingFrequency uint64
+	// effectiveSamplingFrequency is the frequency the perf events are opened with, fixed for the life of the profiler.
+	effectiveSamplingFrequency uint64
+	// maxSampleRate is the maximum sample rate the kernel allowed when it was last read.
+	maxSampleRate uint64
+
+	// perfEvent is the event stacks are sampled on, non clock events are sampled every perfEventPeriod events.
+	perfEvent       PerfEvent
+	perfEventPeriod uint64
+
+	// maxStackDepth is the depth stacks are walked to, stacks reaching it are marked truncated.
+	maxStackDepth int
+
+	// btfPath is the BTF file to load the BPF object with, otherwise on kernels without BTF
+	// the file of the kernel release is looked up in btfArchiveDir.
+	btfPath       string
+	btfArchiveDir string
+
+	// sampleStreaming streams CPU samples with their stacks instead of counting them in the counts map,
+	// the aggregated samples take up to sampleStreamMemoryLimit bytes.
+	sampleStreaming         bool
+	sampleStreamMemoryLimit uint64
+	sampleStream            *sampleStream
+
+	offCPU bool
+
+	heap       bool
+	heapProbes *heapProbes
+	liveHeap   *liveHeap
+
+	dwarfUnwinding bool
+	unwindTables   *unwindTables
+
+	goAlloc       bool
+	goAllocProbes *goAllocProbes
+
+	byteOrder      binary.ByteOrder
+	mapGenerations *mapGenerations
+	targets        *targets
+
+	filterMtx  *sync.Mutex
+	filter     Filter
+	filterMaps *filterMaps
 
 	mtx                         *sync.RWMutex
 	loopStartedAt               time.Time
@@ -62,30 +114,52 @@ type Profiler struct {
 
 	// Caches, caches everywhere!
 	pidMappingFileCache *maps.PIDMappingFileCache
-	ksymCache           *ksym.Cache
 	objFileCache        objectfile.Cache
+	cgroupResolver      *cgroupResolver
 
+	symbolizer        Symbolizer
+	demangleMode      DemangleMode
 	profileWriter     ProfileWriter
 	debugInfoUploader *debuginfo.DebugInfo
+
+	reg     prometheus.Registerer
+	metrics *metrics
+	// bpfCollector exports the BPF statistics and map occupancy, when there is a registerer.
+	bpfCollector *bpfCollector
+
+	podMetadataProvider PodMetadataProvider
+	podLabelKeys        []string
 }
 
 func NewProfiler(logger log.Logger, node string, profilingDuration time.Duration, opts ...Option) *Profiler {
+	objFileCache := objectfile.NewCache(10)
 	p := &Profiler{
 		logger: logger,
 
 		node:              node,
 		profilingDuration: profilingDuration,
+		samplingFrequency: defaultSamplingFrequency,
+		perfEvent:         CPUClockEvent,
+		maxStackDepth:     stackDepth,
+
+		sampleStreamMemoryLimit: defaultSampleStreamMemoryLimit,
 
 		mtx:       &sync.RWMutex{},
 		byteOrder: byteorder.GetHostByteOrder(),
+		targets:   newTargets(TargetAll, nil),
+		filterMtx: &sync.Mutex{},
 
-		ksymCache:           ksym.NewKsymCache(logger),
 		pidMappingFileCache: maps.NewPIDMappingFileCache(logger),
-		objFileCache:        objectfile.NewCache(10),
+		objFileCache:        objFileCache,
+		cgroupResolver:      newCgroupResolver(logger),
+
+		symbolizer:   NewLocalSymbolizer(logger, objFileCache, nil),
+		demangleMode: DemangleSimplified,
 	}
 	for _, opt := range opts {
 		opt(p)
 	}
+	p.metrics = newMetrics(p.reg)
 	return p
 }
 
@@ -95,9 +169,55 @@ func (p *Profiler) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	if p.samplingFrequency == 0 {
+		return errors.New("sampling frequency must be greater than zero")
+	}
+	if p.perfEvent.frequencyBased() && p.perfEventPeriod != 0 {
+		return fmt.Errorf("perf event %s is sampled at the sampling frequency, it takes no period", p.perfEvent.Name)
+	}
+	if p.maxStackDepth < 1 || p.maxStackDepth > stackDepth {
+		return fmt.Errorf("max stack depth must be between 1 and %d", stackDepth)
+	}
+	obj, err := setConstant(bpfObj, maxStackDepthConstName, uint32(p.maxStackDepth))
+	if err != nil {
+		return fmt.Errorf("set max stack depth: %w", err)
+	}
+
+	ringbufSupported, err := bpf.BPFMapTypeIsSupported(bpf.MapTypeRingbuf)
+	if err != nil {
+		level.Debug(p.logger).Log("msg", "failed to probe ring buffer support", "err", err)
+	}
+	output := sampleOutput(p.sampleStreaming, ringbufSupported)
+	obj, err = setConstant(obj, sampleOutputConstName, output)
+	if err != nil {
+		return fmt.Errorf("set sample output: %w", err)
+	}
+
+	if p.dwarfUnwinding && !dwarfUnwindingSupported {
+		level.Warn(p.logger).Log("msg", "DWARF unwinding is not supported on this architecture, using frame pointers", "arch", runtime.GOARCH)
+		p.dwarfUnwinding = false
+	}
+	var dwarfUnwinding uint32
+	if p.dwarfUnwinding {
+		dwarfUnwinding = 1
+	}
+	obj, err = setConstant(obj, dwarfUnwindingConstName, dwarfUnwinding)
+	if err != nil {
+		return fmt.Errorf("set DWARF unwinding: %w", err)
+	}
+
+	btfPath, err := btfObjPath(p.btfPath, p.btfArchiveDir)
+	if err != nil {
+		return fmt.Errorf("find kernel BTF: %w", err)
+	}
+	if btfPath != "" {
+		level.Info(p.logger).Log("msg", "loading BPF object with external BTF", "path", btfPath)
+	}
+
 	m, err := bpf.NewModuleFromBufferArgs(bpf.NewModuleArgs{
-		BPFObjBuff: bpfObj,
+		BPFObjBuff: obj,
 		BPFObjName: "tiny-profiler",
+		BTFObjPath: btfPath,
 	})
 	if err != nil {
 		return fmt.Errorf("new bpf module: %w", err)
@@ -107,21 +227,69 @@ func (p *Profiler) Run(ctx context.Context) error {
 	if err := p.bumpMemlockRlimit(); err != nil {
 		return fmt.Errorf("bump memlock rlimit: %w", err)
 	}
+	if err := checkKernelFeatures(); err != nil {
+		return err
+	}
+	if p.dwarfUnwinding {
+		if err := checkDWARFUnwindingFeatures(); err != nil {
+			return err
+		}
+	}
+
+	// Off-CPU, heap and Go allocation programs are only loaded when they are going to be attached.
+	autoload := map[string]bool{
+		offCPUSwitchProgramName: p.offCPU,
+		offCPUWakeupProgramName: p.offCPU,
+	}
+	for _, name := range heapProgramNames {
+		autoload[name] = p.heap
+	}
+	autoload[goMallocgcProgramName] = p.goAlloc
+	autoload[goMallocgcStackProgramName] = p.goAlloc
+	for name, enabled := range autoload {
+		prog, err := m.GetProgram(name)
+		if err != nil {
+			return fmt.Errorf("get bpf program: %w", err)
+		}
+		if err := prog.SetAutoload(enabled); err != nil {
+			return fmt.Errorf("set autoload of %s: %w", name, err)
+		}
+	}
+
+	// The kernel walks stacks as deep as the stack trace map values are big.
+	for generation := 0; generation < 2; generation++ {
+		stackTraces, err := m.GetMap(generationMapName(stackTracesMapName, generation))
+		if err != nil {
+			return fmt.Errorf("get stack traces map: %w", err)
+		}
+		if err := stackTraces.SetValueSize(uint32(p.maxStackDepth * 8)); err != nil {
+			return fmt.Errorf("set stack traces value size: %w", err)
+		}
+	}
+	if err := configureSampleMaps(m, output, ringbufSupported); err != nil {
+		return fmt.Errorf("configure sample maps: %w", err)
+	}
 
 	if err := m.BPFLoadObject(); err != nil {
 		return fmt.Errorf("load bpf object: %w", err)
 	}
 
+	p.setSamplingFrequency()
+
+	if p.sampleStreaming {
+		p.sampleStream = newSampleStream(p.logger, p.byteOrder, p.metrics, p.sampleStreamMemoryLimit)
+		stop, err := p.sampleStream.start(m, output)
+		if err != nil {
+			return fmt.Errorf("start sample stream: %w", err)
+		}
+		defer stop()
+		level.Debug(p.logger).Log("msg", "streaming samples", "ringbuf", output == sampleOutputRingbuf)
+	}
+
 	cpus := runtime.NumCPU()
 
 	for i := 0; i < cpus; i++ {
-		fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
-			Type:   unix.PERF_TYPE_SOFTWARE,
-			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
-			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
-			Sample: 100,
-			Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
-		}, -1 /* pid */, i /* cpu id */, -1 /* group */, 0 /* flags */)
+		fd, err := p.openPerfEvent(i)
 		if err != nil {
 			return fmt.Errorf("open perf event: %w", err)
 		}
@@ -137,16 +305,75 @@ func (p *Profiler) Run(ctx context.Context) error {
 		}
 	}
 
-	counts, err := m.GetMap(countsMapName)
+	if p.offCPU {
+		for name, event := range map[string]string{
+			offCPUSwitchProgramName: "sched_switch",
+			offCPUWakeupProgramName: "sched_wakeup",
+		} {
+			prog, err := m.GetProgram(name)
+			if err != nil {
+				return fmt.Errorf("get bpf program: %w", err)
+			}
+			if _, err := prog.AttachTracepoint("sched", event); err != nil {
+				return fmt.Errorf("attach %s tracepoint: %w", event, err)
+			}
+		}
+	}
+
+	if p.heap {
+		p.heapProbes = newHeapProbes(p.logger, m, p.targets)
+		defer p.heapProbes.close()
+		if err := p.heapProbes.attach(); err != nil {
+			return fmt.Errorf("attach heap probes: %w", err)
+		}
+		if p.liveHeap, err = newLiveHeap(m, p.byteOrder); err != nil {
+			return err
+		}
+	}
+	if p.goAlloc {
+		p.goAllocProbes = newGoAllocProbes(p.logger, m, p.targets)
+		defer p.goAllocProbes.close()
+		p.goAllocProbes.attach()
+	}
+
+	p.mapGenerations, err = newMapGenerations(m, p.byteOrder)
 	if err != nil {
-		return fmt.Errorf("get counts map: %w", err)
+		return err
+	}
+	if p.reg != nil {
+		p.bpfCollector, err = newBPFCollector(m, p.byteOrder, p.mapGenerations)
+		if err != nil {
+			return fmt.Errorf("create BPF metrics collector: %w", err)
+		}
+		if err := p.reg.Register(p.bpfCollector); err != nil {
+			return fmt.Errorf("register BPF metrics collector: %w", err)
+		}
+	}
+	if p.dwarfUnwinding {
+		tables, err := m.GetMap(unwindTablesMapName)
+		if err != nil {
+			return fmt.Errorf("get unwind tables map: %w", err)
+		}
+		p.unwindTables = newUnwindTables(p.logger, p.byteOrder, tables)
+		defer p.unwindTables.close()
 	}
 
-	stackTraces, err := m.GetMap(stackTracesMapName)
+	filterMaps, err := newFilterMaps(m, p.byteOrder)
+	if err != nil {
+		return err
+	}
+	p.filterMtx.Lock()
+	p.filterMaps = filterMaps
+	err = filterMaps.update(p.effectiveFilter())
+	p.filterMtx.Unlock()
 	if err != nil {
-		return fmt.Errorf("get stack traces map: %w", err)
+		return fmt.Errorf("apply target filter: %w", err)
 	}
-	p.bpfMaps = &bpfMaps{byteOrder: byteorder.GetHostByteOrder(), counts: counts, stackTraces: stackTraces}
+	defer func() {
+		p.filterMtx.Lock()
+		p.filterMaps = nil
+		p.filterMtx.Unlock()
+	}()
 
 	ticker := time.NewTicker(p.profilingDuration)
 	defer ticker.Stop()
@@ -159,6 +386,19 @@ func (p *Profiler) Run(ctx context.Context) error {
 		case <-ticker.C:
 		}
 
+		// The kernel lowers the maximum sample rate when sampling interrupts take too long.
+		p.checkMaxSampleRate()
+
+		if p.heapProbes != nil {
+			// Probe the C libraries of processes started since the last loop.
+			if err := p.heapProbes.attach(); err != nil {
+				level.Warn(p.logger).Log("msg", "failed to attach heap probes", "err", err)
+			}
+		}
+		if p.goAllocProbes != nil {
+			p.goAllocProbes.attach()
+		}
+
 		if err := p.profileLoop(ctx); err != nil {
 			level.Warn(p.logger).Log("msg", "profile loop error", "err", err)
 		}
@@ -186,100 +426,317 @@ func (p *Profiler) profileStartedAt() time.Time {
 
 type combinedStack [doubleStackDepth]uint64
 
+// sampleKey identifies a sample within the profile of a single process.
+type sampleKey struct {
+	tid   uint32
+	comm  [taskCommLen]byte
+	stack combinedStack
+}
+
 type PID uint64
 
 type Profile struct {
+	profileType profileType
 	captureTime time.Time
 
-	samples map[combinedStack]*profile.Sample
+	samples map[sampleKey]*profile.Sample
 
 	allLocations    []*profile.Location
 	userLocations   map[uint32][]*profile.Location
 	kernelLocations []*profile.Location
+	// syntheticFunctions are the functions of the locations that don't need symbolization, e.g. [truncated].
+	syntheticFunctions []*profile.Function
 
-	userMappings  []*profile.Mapping
-	kernelMapping *profile.Mapping
+	userMappings   []*profile.Mapping
+	kernelMappings []*profile.Mapping
 }
 
 type stackCountKey struct {
-	PID           uint32
-	UserStackID   int32
-	KernelStackID int32
+	PID            uint32
+	TID            uint32
+	UserStackID    int32
+	KernelStackID  int32
+	CgroupID       uint64
+	Comm           [taskCommLen]byte
+	UserStackDWARF uint32
+	KernelThread   uint32
+	Generation     uint32
+	OffCPUStacks   uint32
+}
+
+// profileType describes a kind of profile that is built from a BPF map of stack counts.
+type profileType struct {
+	// name is the value of the __name__ label of the written profiles.
+	name        string
+	counts      *bpf.BPFMap
+	sampleTypes []*profile.ValueType
+	periodType  *profile.ValueType
+	period      int64
+	// values converts a value of the counts map to the sample values.
+	values func(valueBytes []byte) []int64
+	// maps are the maps of the generation the counts map belongs to.
+	maps *bpfMaps
+	// stream aggregates the samples instead of the counts map, when they are streamed.
+	stream *sampleStream
+	// liveHeap keeps the allocation sites with live allocations across windows, for the heap profile.
+	liveHeap *liveHeap
+}
+
+// stackSample is a sampled stack with its raw counter value, counted in a counts map or aggregated from the stream.
+type stackSample struct {
+	key   stackCountKey
+	stack combinedStack
+	// userErr and kernelErr tell why the user or kernel part of the stack is missing.
+	userErr    error
+	kernelErr  error
+	valueBytes []byte
+	// reported is whether the sample was already reported in a previous window, so its stack walk failures are too.
+	reported bool
+}
+
+// profileTypes returns the kinds of profiles collected in the current loop, read from the maps of the given generation.
+func (p *Profiler) profileTypes(generation *bpfMaps) []profileType {
+	var types []profileType
+	if p.perfEvent.frequencyBased() {
+		types = append(types, profileType{
+			name:        p.perfEvent.profileName(),
+			counts:      generation.counts,
+			maps:        generation,
+			sampleTypes: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+			// Sampling at 100Hz means a sample every 10 Million nanoseconds.
+			periodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+			period:     int64(time.Second) / int64(p.effectiveSamplingFrequency),
+			values:     p.countValues(1),
+			stream:     p.sampleStream,
+		})
+	} else {
+		// Every sample stands for period events, so the values estimate the number of events.
+		period := int64(p.samplePeriod())
+		types = append(types, profileType{
+			name:        p.perfEvent.profileName(),
+			counts:      generation.counts,
+			maps:        generation,
+			sampleTypes: []*profile.ValueType{{Type: p.perfEvent.sampleTypeName(), Unit: "count"}},
+			periodType:  &profile.ValueType{Type: p.perfEvent.sampleTypeName(), Unit: "count"},
+			period:      period,
+			values:      p.countValues(period),
+			stream:      p.sampleStream,
+		})
+	}
+	if p.offCPU {
+		types = append(types, profileType{
+			name:        "tiny_profiler_offcpu",
+			counts:      generation.offCPUCounts,
+			maps:        generation,
+			sampleTypes: []*profile.ValueType{{Type: "offcpu", Unit: "nanoseconds"}},
+			periodType:  &profile.ValueType{Type: "offcpu", Unit: "nanoseconds"},
+			period:      1,
+			values:      p.countValues(1),
+		})
+	}
+	if p.heap {
+		types = append(types, profileType{
+			name:   "tiny_profiler_heap",
+			counts: generation.allocCounts,
+			maps:   generation,
+			sampleTypes: []*profile.ValueType{
+				{Type: "alloc_objects", Unit: "count"},
+				{Type: "alloc_space", Unit: "bytes"},
+				{Type: "inuse_objects", Unit: "count"},
+				{Type: "inuse_space", Unit: "bytes"},
+			},
+			periodType: &profile.ValueType{Type: "space", Unit: "bytes"},
+			period:     1,
+			values:     p.allocValues,
+			liveHeap:   p.liveHeap,
+		})
+	}
+	if p.goAlloc {
+		types = append(types, profileType{
+			name:   "tiny_profiler_go_alloc",
+			counts: generation.goAllocCounts,
+			maps:   generation,
+			sampleTypes: []*profile.ValueType{
+				{Type: "alloc_objects", Unit: "count"},
+				{Type: "alloc_space", Unit: "bytes"},
+			},
+			periodType: &profile.ValueType{Type: "space", Unit: "bytes"},
+			period:     1,
+			values: func(valueBytes []byte) []int64 {
+				// Frees aren't traced, so only the allocation counters are meaningful.
+				return p.allocValues(valueBytes)[:2]
+			},
+		})
+	}
+	return types
+}
+
+// countValues returns a converter of single counter values, scaled by the given factor.
+func (p *Profiler) countValues(scale int64) func([]byte) []int64 {
+	return func(valueBytes []byte) []int64 {
+		return []int64{int64(p.byteOrder.Uint64(valueBytes)) * scale}
+	}
+}
+
+// allocValues converts the allocation counters of a stack.
+func (p *Profiler) allocValues(valueBytes []byte) []int64 {
+	return []int64{
+		int64(p.byteOrder.Uint64(valueBytes[0:8])),
+		int64(p.byteOrder.Uint64(valueBytes[8:16])),
+		int64(p.byteOrder.Uint64(valueBytes[16:24])),
+		int64(p.byteOrder.Uint64(valueBytes[24:32])),
+	}
 }
 
 func (p *Profiler) profileLoop(ctx context.Context) error {
 	var (
+		isTarget        = p.targetMatcher()
 		processMappings = maps.NewMapping(p.pidMappingFileCache)
-		kernelMapping   = &profile.Mapping{
-			File: "[kernel.kallsyms]",
+	)
+
+	// Samples recorded while the previous generation is read go to the other one.
+	generation, err := p.mapGenerations.switchGeneration()
+	if err != nil {
+		return fmt.Errorf("switch map generation: %w", err)
+	}
+
+	var unwindCandidates []PID
+	for _, pt := range p.profileTypes(generation) {
+		candidates, err := p.collectProfiles(ctx, pt, isTarget, processMappings)
+		if err != nil {
+			return fmt.Errorf("collect %s profiles: %w", pt.name, err)
+		}
+		unwindCandidates = append(unwindCandidates, candidates...)
+	}
+
+	if p.unwindTables != nil {
+		p.unwindTables.update(unwindCandidates)
+	}
+
+	_, mappedFiles := processMappings.AllMappings()
+
+	if p.debugInfoUploader != nil {
+		// Upload debug information of the discovered object files.
+		go func() {
+			var objFiles []*objectfile.MappedObjectFile
+			for _, mf := range mappedFiles {
+				objFile, err := p.objFileCache.ObjectFileForProcess(mf.PID, mf.Mapping)
+				if err != nil {
+					continue
+				}
+				objFiles = append(objFiles, objFile)
+			}
+			p.debugInfoUploader.EnsureUploaded(ctx, objFiles)
+		}()
+	}
+
+	if err := generation.clean(); err != nil {
+		level.Warn(p.logger).Log("msg", "failed to clean BPF maps", "err", err)
+	}
+	occupancy := generation.takeOccupancy()
+	if p.liveHeap != nil {
+		live, err := p.liveHeap.dropExited()
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "failed to drop allocations of exited processes", "err", err)
 		}
+		occupancy[p.liveHeap.allocs] = live
+	}
+	if p.bpfCollector != nil {
+		p.bpfCollector.setOccupancy(occupancy)
+	}
+
+	return nil
+}
 
-		allSamples      = map[PID]map[combinedStack]*profile.Sample{}
+// collectProfiles builds and writes a profile of the given type for every targeted process found in its counts map.
+// It returns the processes whose user stacks couldn't be walked using frame pointers.
+func (p *Profiler) collectProfiles(ctx context.Context, pt profileType, isTarget func(PID) bool, processMappings *maps.Mapping) ([]PID, error) {
+	modules, err := readKernelModules()
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to read kernel modules", "err", err)
+	}
+
+	var (
+		kernelMappings = newKernelMappings(modules)
+
+		allSamples      = map[PID]map[sampleKey]*profile.Sample{}
 		sampleLocations = map[PID][]*profile.Location{}
 		allLocations    = map[PID][]*profile.Location{}
 		kernelLocations = map[PID][]*profile.Location{}
 		userLocations   = map[PID]map[uint32][]*profile.Location{} // PID -> []*profile.Location
 		locationIndices = map[PID]map[[2]uint64]int{}              // [PID, Address] -> index in locations
+		cgroupIDs       = map[PID]uint64{}
+		shallowStacks   = map[PID]struct{}{}
+
+		syntheticLocations = map[PID]map[string]*profile.Location{}
+		syntheticFunctions = map[PID][]*profile.Function{}
 	)
 
-	processes := goprocess.FindAll()
-	for _, ps := range processes {
-		level.Debug(p.logger).Log("msg", "attaching profiler to processes", "pid", ps.PID, "path", ps.Path)
+	// syntheticLocation returns the location of a frame that stands for something else than an address, e.g. [truncated].
+	syntheticLocation := func(pid PID, name string) *profile.Location {
+		if _, ok := syntheticLocations[pid]; !ok {
+			syntheticLocations[pid] = map[string]*profile.Location{}
+		}
+		l, ok := syntheticLocations[pid][name]
+		if !ok {
+			f := &profile.Function{Name: name}
+			l = &profile.Location{
+				ID:   uint64(len(allLocations[pid]) + 1),
+				Line: []profile.Line{{Function: f}},
+			}
+			allLocations[pid] = append(allLocations[pid], l)
+			syntheticFunctions[pid] = append(syntheticFunctions[pid], f)
+			syntheticLocations[pid][name] = l
+		}
+		return l
 	}
 
-	it := p.bpfMaps.counts.Iterator()
-	for it.Next() {
-		keyBytes := it.Key()
-
-		var key stackCountKey
-		if err := binary.Read(bytes.NewBuffer(keyBytes), p.byteOrder, &key); err != nil {
-			return fmt.Errorf("read stack count key: %w", err)
-		}
+	forEachSample := p.forEachCountedSample
+	switch {
+	case pt.stream != nil:
+		forEachSample = pt.stream.forEachSample
+	case pt.liveHeap != nil:
+		forEachSample = p.forEachLiveHeapSample
+	}
+	err = forEachSample(pt, isTarget, func(s *stackSample) error {
+		key, stack, userErr, kernelErr := s.key, s.stack, s.userErr, s.kernelErr
 
 		pid := PID(key.PID)
-		i := sort.Search(len(processes), func(i int) bool {
-			return PID(processes[i].PID) >= pid
-		})
-		if !(i < len(processes) && PID(processes[i].PID) == pid) {
-			continue
-		}
+		cgroupIDs[pid] = key.CgroupID
 
-		stack := combinedStack{}
-		userErr := p.bpfMaps.readUserStack(key.UserStackID, &stack)
-		if userErr != nil {
-			if errors.Is(userErr, errUnrecoverable) {
-				return userErr
-			}
-			level.Debug(p.logger).Log("msg", "failed to read user stack", "err", userErr)
+		if userErr != nil && !s.reported {
+			p.stackWalkFailed("user", userErr)
 		}
-		kernelErr := p.bpfMaps.readKernelStack(key.KernelStackID, &stack)
-		if kernelErr != nil {
-			if errors.Is(kernelErr, errUnrecoverable) {
-				return kernelErr
-			}
-			level.Debug(p.logger).Log("msg", "failed to read kernel stack", "err", kernelErr)
+		if key.KernelThread == 0 && key.UserStackDWARF == 0 && (userErr != nil || stack[1] == 0) {
+			// Frame pointer unwinding stops after the first frame of binaries built without them.
+			shallowStacks[pid] = struct{}{}
 		}
-		if userErr != nil && kernelErr != nil {
-			continue
+		if kernelErr != nil && !s.reported {
+			p.stackWalkFailed("kernel", kernelErr)
 		}
-
-		value, err := p.bpfMaps.readStackCount(keyBytes)
-		if err != nil {
-			return fmt.Errorf("read value: %w", err)
+		// Samples whose user stack couldn't be walked are kept, their CPU time still counts.
+		userUnknown := userErr != nil && !errors.Is(userErr, errNoStack)
+		if userErr != nil && kernelErr != nil && !userUnknown {
+			return nil
 		}
-		if value == 0 {
-			continue
+
+		values := pt.values(s.valueBytes)
+		if allZero(values) {
+			return nil
 		}
 
 		_, ok := allSamples[pid]
 		if !ok {
-			allSamples[pid] = map[combinedStack]*profile.Sample{}
+			allSamples[pid] = map[sampleKey]*profile.Sample{}
 		}
 
-		sample, ok := allSamples[pid][stack]
+		sk := sampleKey{tid: key.TID, comm: key.Comm, stack: stack}
+		sample, ok := allSamples[pid][sk]
 		if ok {
-			sample.Value[0] += int64(value)
-			continue
+			for i, v := range values {
+				sample.Value[i] += v
+			}
+			return nil
 		}
 
 		sampleLocations[pid] = []*profile.Location{}
@@ -301,7 +758,7 @@ func (p *Profiler) profileLoop(ctx context.Context) error {
 					l := &profile.Location{
 						ID:      uint64(locationIndex + 1),
 						Address: addr,
-						Mapping: kernelMapping,
+						Mapping: kernelMappings.mapping(addr),
 					}
 					allLocations[pid] = append(allLocations[pid], l)
 					kernelLocations[pid] = append(kernelLocations[pid], l)
@@ -313,6 +770,11 @@ func (p *Profiler) profileLoop(ctx context.Context) error {
 				)
 			}
 		}
+		// Stacks that fill every frame most likely went deeper, they get a synthetic frame where they were cut.
+		// A truncated kernel stack gets it between the kernel and the user frames.
+		if stack[stackDepth+p.maxStackDepth-1] != 0 {
+			sampleLocations[pid] = append(sampleLocations[pid], syntheticLocation(pid, truncatedFunctionName))
+		}
 
 		// Collect User stack trace samples.
 		for _, addr := range stack[:stackDepth] {
@@ -347,79 +809,148 @@ func (p *Profiler) profileLoop(ctx context.Context) error {
 			}
 		}
 
+		if userUnknown {
+			sampleLocations[pid] = append(sampleLocations[pid], syntheticLocation(pid, unknownUserStackFunctionName))
+		}
+
+		if stack[p.maxStackDepth-1] != 0 {
+			sampleLocations[pid] = append(sampleLocations[pid], syntheticLocation(pid, truncatedFunctionName))
+		}
+
 		sample = &profile.Sample{
-			Value:    []int64{int64(value)},
+			Value:    values,
 			Location: sampleLocations[pid],
+			Label: map[string][]string{
+				"thread_id":   {fmt.Sprintf("%d", key.TID)},
+				"thread_name": {string(bytes.TrimRight(key.Comm[:], "\x00"))},
+			},
 		}
-		allSamples[pid][stack] = sample
-	}
-	if it.Err() != nil {
-		// TODO(kakkoyun): What happened now?
-		// return fmt.Errorf("failed iterator: %w", it.Err())
-		level.Warn(p.logger).Log("msg", "failed iterator", "err", it.Err())
+		allSamples[pid][sk] = sample
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	var mappedFiles []maps.ProcessMapping
-	mappings, mappedFiles := processMappings.AllMappings()
-
-	if p.debugInfoUploader != nil {
-		// Upload debug information of the discovered object files.
-		go func() {
-			var objFiles []*objectfile.MappedObjectFile
-			for _, mf := range mappedFiles {
-				objFile, err := p.objFileCache.ObjectFileForProcess(mf.PID, mf.Mapping)
-				if err != nil {
-					continue
-				}
-				objFiles = append(objFiles, objFile)
-			}
-			p.debugInfoUploader.EnsureUploaded(ctx, objFiles)
-		}()
-	}
+	mappings, _ := processMappings.AllMappings()
 
 	for pid, samples := range allSamples {
 		prof := &Profile{
-			captureTime:     p.profileStartedAt(),
-			samples:         samples,
-			allLocations:    allLocations[pid],
-			kernelLocations: kernelLocations[pid],
-			userLocations:   userLocations[pid],
-			userMappings:    mappings,
-			kernelMapping:   kernelMapping,
-		}
-		pprof, err := p.pprofProfile(prof)
+			profileType:        pt,
+			captureTime:        p.profileStartedAt(),
+			samples:            samples,
+			allLocations:       allLocations[pid],
+			kernelLocations:    kernelLocations[pid],
+			userLocations:      userLocations[pid],
+			syntheticFunctions: syntheticFunctions[pid],
+			userMappings:       mappings,
+			kernelMappings:     kernelMappings.mappings,
+		}
+		pprof, err := p.pprofProfile(ctx, prof)
 		if err != nil {
-			return fmt.Errorf("failed to build profile: %w", err)
+			return nil, fmt.Errorf("failed to build profile: %w", err)
 		}
 
-		labels := map[string]string{}
-		labels["__name__"] = "tiny_profiler_cpu"
+		labels := processLabels(pid)
+		for k, v := range p.cgroupLabels(pid, cgroupIDs[pid]) {
+			labels[k] = v
+		}
+		for k, v := range p.podLabels(ctx, pid) {
+			labels[k] = v
+		}
+		labels["__name__"] = pt.name
 		labels["node"] = p.node
 		labels["pid"] = fmt.Sprintf("%d", pid)
-		ps, ok, _ := goprocess.Find(int(pid))
-		if ok {
-			labels["exec"] = ps.Exec
-			labels["path"] = ps.Path
-			labels["build_version"] = ps.BuildVersion
-		}
 		if err := p.profileWriter.Write(ctx, labels, pprof); err != nil {
 			level.Error(p.logger).Log("msg", "failed to write profile", "err", err)
 		}
+	}
 
-		if err := p.bpfMaps.clean(); err != nil {
-			level.Warn(p.logger).Log("msg", "failed to clean BPF maps", "err", err)
+	candidates := make([]PID, 0, len(shallowStacks))
+	for pid := range shallowStacks {
+		candidates = append(candidates, pid)
+	}
+	return candidates, nil
+}
+
+// forEachCountedSample calls fn with the samples of the targeted processes counted in the counts map of the given profile type.
+func (p *Profiler) forEachCountedSample(pt profileType, isTarget func(PID) bool, fn func(*stackSample) error) error {
+	return p.forEachCount(pt, func(keyBytes, valueBytes []byte) error {
+		s := &stackSample{valueBytes: valueBytes}
+		if err := binary.Read(bytes.NewBuffer(keyBytes), p.byteOrder, &s.key); err != nil {
+			return fmt.Errorf("read stack count key: %w", err)
 		}
+		if !isTarget(PID(s.key.PID)) {
+			return nil
+		}
+		if err := pt.maps.readStacks(s); err != nil {
+			return err
+		}
+		return fn(s)
+	})
+}
+
+// forEachCount calls fn with the raw keys and values of the counts map of the given profile type.
+// Where the kernel supports it the counts are read and deleted in batches, otherwise they are read one by one.
+func (p *Profiler) forEachCount(pt profileType, fn func(keyBytes, valueBytes []byte) error) error {
+	drained, err := pt.maps.lookupAndDeleteAll(pt.counts, fn)
+	if err != nil || drained {
+		return err
 	}
 
+	it := pt.counts.Iterator()
+	for it.Next() {
+		keyBytes := it.Key()
+		valueBytes, err := pt.maps.readStackCount(pt.counts, keyBytes)
+		if err != nil {
+			return fmt.Errorf("read value: %w", err)
+		}
+		if err := fn(keyBytes, valueBytes); err != nil {
+			return err
+		}
+	}
+	if it.Err() != nil {
+		// TODO(kakkoyun): What happened now?
+		// return fmt.Errorf("failed iterator: %w", it.Err())
+		level.Warn(p.logger).Log("msg", "failed iterator", "err", it.Err())
+	}
 	return nil
 }
 
+// stackWalkFailed accounts for a stack of a sample that couldn't be walked or read.
+func (p *Profiler) stackWalkFailed(stack string, err error) {
+	if errors.Is(err, errNoStack) {
+		return
+	}
+	reason := stackFailureUnknown
+	var walkErr *stackWalkError
+	if errors.As(err, &walkErr) {
+		reason = walkErr.reason
+	}
+	p.metrics.stackWalkFailures.WithLabelValues(stack, reason).Inc()
+	level.Debug(p.logger).Log("msg", "failed to read "+stack+" stack", "reason", reason, "err", err)
+}
+
+func allZero(values []int64) bool {
+	for _, v := range values {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // normalizeProfile calculates the base addresses of a position-independent binary and normalizes captured locations accordingly.
 func (p *Profiler) normalizeAddress(m *profile.Mapping, pid uint32, addr uint64) uint64 {
 	if m == nil {
 		return addr
 	}
 
+	// Anonymous mappings hold just-in-time compiled code, which is symbolized by its absolute address.
+	if m.File == "" {
+		return addr
+	}
+
 	logger := log.With(p.logger, "pid", pid, "buildID", m.BuildID)
 	if m.Unsymbolizable() {
 		level.Debug(logger).Log("msg", "mapping is unsymbolizable")
@@ -442,6 +973,64 @@ func (p *Profiler) normalizeAddress(m *profile.Mapping, pid uint32, addr uint64)
 	return normalizedAddr
 }
 
+// setSamplingFrequency clamps the requested sampling frequency to the maximum the kernel allows
+// before the perf events are opened. The profiles report the period of that frequency.
+func (p *Profiler) setSamplingFrequency() {
+	effective := p.samplingFrequency
+	maxRate, err := maxSampleRate()
+	if err != nil {
+		level.Debug(p.logger).Log("msg", "failed to read max sample rate", "err", err)
+	} else if maxRate > 0 && maxRate < effective {
+		effective = maxRate
+	}
+	p.maxSampleRate = maxRate
+
+	if effective < p.samplingFrequency {
+		level.Warn(p.logger).Log(
+			"msg", "sampling frequency clamped by "+perfEventMaxSampleRatePath,
+			"requested_hz", p.samplingFrequency,
+			"effective_hz", effective,
+		)
+	} else {
+		level.Debug(p.logger).Log("msg", "sampling frequency", "effective_hz", effective)
+	}
+	p.effectiveSamplingFrequency = effective
+}
+
+// checkMaxSampleRate warns when the kernel lowers the maximum sample rate below the frequency the perf events
+// were opened with. The perf events are throttled to that rate then, and the profiles undercount.
+func (p *Profiler) checkMaxSampleRate() {
+	maxRate, err := maxSampleRate()
+	if err != nil {
+		level.Debug(p.logger).Log("msg", "failed to read max sample rate", "err", err)
+		return
+	}
+	if maxRate == p.maxSampleRate {
+		return
+	}
+	p.maxSampleRate = maxRate
+	if maxRate > 0 && maxRate < p.effectiveSamplingFrequency {
+		level.Warn(p.logger).Log(
+			"msg", "max sample rate lowered below the sampling frequency by "+perfEventMaxSampleRatePath+", profiles undercount",
+			"sampling_hz", p.effectiveSamplingFrequency,
+			"max_sample_rate", maxRate,
+		)
+	}
+}
+
+// maxSampleRate returns the highest sampling frequency the kernel currently allows for perf events.
+func maxSampleRate() (uint64, error) {
+	b, err := os.ReadFile(perfEventMaxSampleRatePath)
+	if err != nil {
+		return 0, err
+	}
+	rate, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", perfEventMaxSampleRatePath, err)
+	}
+	return rate, nil
+}
+
 // bumpMemlockRlimit increases the current memlock limit to a value more reasonable for the profiler's needs.
 func (p *Profiler) bumpMemlockRlimit() error {
 	rLimit := syscall.Rlimit{
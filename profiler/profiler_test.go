@@ -0,0 +1,23 @@
+package profiler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestRunInvalidSamplingFrequency(t *testing.T) {
+	p := NewProfiler(log.NewNopLogger(), "test", 10*time.Second, WithSamplingFrequency(0))
+	if err := p.Run(context.Background()); err == nil {
+		t.Fatal("got no error for a sampling frequency of zero")
+	}
+}
+
+func TestRunPeriodWithCPUClock(t *testing.T) {
+	p := NewProfiler(log.NewNopLogger(), "test", 10*time.Second, WithPerfEvent(CPUClockEvent, 1000))
+	if err := p.Run(context.Background()); err == nil {
+		t.Fatal("got no error for a period of the cpu-clock event")
+	}
+}
@@ -0,0 +1,223 @@
+package profiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	samplesRingbufMapName = "samples_ringbuf"
+	samplesPerfbufMapName = "samples_perfbuf"
+	sampleOutputConstName = "sample_output"
+
+	// Where the BPF program puts CPU samples, same as SAMPLE_OUTPUT_* in the BPF program.
+	sampleOutputMaps    = 0
+	sampleOutputRingbuf = 1
+	sampleOutputPerfbuf = 2
+
+	// samplesPerfbufPages is the size of the perf buffer of every CPU, in pages.
+	samplesPerfbufPages = 64
+	// sampleEventsBuffer is the amount of streamed samples that may wait to be aggregated.
+	sampleEventsBuffer = 4096
+	// lostEventsBuffer is the amount of lost samples notifications that may wait to be counted.
+	lostEventsBuffer = 64
+
+	// defaultSampleStreamMemoryLimit bounds the memory the aggregated streamed samples use, in bytes.
+	defaultSampleStreamMemoryLimit = 64 << 20
+)
+
+// streamKey identifies the aggregated samples of a task and stack.
+type streamKey struct {
+	key   stackCountKey
+	stack combinedStack
+}
+
+// streamEntrySize estimates the memory an aggregated stack takes.
+const streamEntrySize = int(unsafe.Sizeof(streamKey{})) + 8
+
+// sampleStream aggregates the CPU samples that the BPF program streams with their raw stacks.
+// Unlike the counts map it doesn't drop samples when the stacks of a window don't fit,
+// its memory is bounded by a limit on the amount of different stacks instead.
+type sampleStream struct {
+	logger    log.Logger
+	byteOrder binary.ByteOrder
+	metrics   *metrics
+	maxStacks int
+
+	mtx    *sync.Mutex
+	counts map[streamKey]uint64
+}
+
+func newSampleStream(logger log.Logger, byteOrder binary.ByteOrder, metrics *metrics, memoryLimit uint64) *sampleStream {
+	return &sampleStream{
+		logger:    logger,
+		byteOrder: byteOrder,
+		metrics:   metrics,
+		maxStacks: int(memoryLimit / uint64(streamEntrySize)),
+		mtx:       &sync.Mutex{},
+		counts:    map[streamKey]uint64{},
+	}
+}
+
+// sampleOutput returns where the BPF program puts CPU samples. Streamed samples go through
+// the ring buffer, or through the perf buffer on kernels older than 5.8.
+func sampleOutput(streaming, ringbufSupported bool) uint32 {
+	switch {
+	case !streaming:
+		return sampleOutputMaps
+	case ringbufSupported:
+		return sampleOutputRingbuf
+	default:
+		return sampleOutputPerfbuf
+	}
+}
+
+// configureSampleMaps sizes the maps of the streamed samples before the BPF object is loaded.
+func configureSampleMaps(m *bpf.Module, output uint32, ringbufSupported bool) error {
+	ringbuf, err := m.GetMap(samplesRingbufMapName)
+	if err != nil {
+		return fmt.Errorf("get samples ring buffer: %w", err)
+	}
+	if output == sampleOutputRingbuf {
+		return nil
+	}
+	if ringbufSupported {
+		// The ring buffer isn't used, it only needs to be valid.
+		return ringbuf.Resize(uint32(os.Getpagesize()))
+	}
+	// Older kernels can't create ring buffers even when they aren't used, a tiny queue takes its place.
+	if err := ringbuf.SetType(bpf.MapTypeQueue); err != nil {
+		return fmt.Errorf("replace samples ring buffer: %w", err)
+	}
+	if err := ringbuf.SetValueSize(8); err != nil {
+		return fmt.Errorf("replace samples ring buffer: %w", err)
+	}
+	return ringbuf.Resize(1)
+}
+
+// start starts polling the buffer of the streamed samples and aggregating them.
+// The returned function stops polling, the samples are aggregated until then.
+func (s *sampleStream) start(m *bpf.Module, output uint32) (func(), error) {
+	events := make(chan []byte, sampleEventsBuffer)
+	var (
+		lost chan uint64
+		stop func()
+	)
+	switch output {
+	case sampleOutputRingbuf:
+		rb, err := m.InitRingBuf(samplesRingbufMapName, events)
+		if err != nil {
+			return nil, fmt.Errorf("init samples ring buffer: %w", err)
+		}
+		rb.Start()
+		stop = rb.Close
+	case sampleOutputPerfbuf:
+		lost = make(chan uint64, lostEventsBuffer)
+		pb, err := m.InitPerfBuf(samplesPerfbufMapName, events, lost, samplesPerfbufPages)
+		if err != nil {
+			return nil, fmt.Errorf("init samples perf buffer: %w", err)
+		}
+		pb.Start()
+		stop = pb.Close
+	default:
+		return nil, fmt.Errorf("samples aren't streamed")
+	}
+
+	go s.run(events, lost)
+	return stop, nil
+}
+
+// run aggregates streamed samples until the buffer is stopped and its channels are closed.
+// It keeps reading them until then, the buffer blocks while a channel is full.
+func (s *sampleStream) run(events <-chan []byte, lost <-chan uint64) {
+	for events != nil || lost != nil {
+		select {
+		case raw, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if err := s.add(raw); err != nil {
+				level.Debug(s.logger).Log("msg", "failed to read streamed sample", "err", err)
+			}
+		case n, ok := <-lost:
+			if !ok {
+				lost = nil
+				continue
+			}
+			s.metrics.streamedSamplesDropped.WithLabelValues("lost").Add(float64(n))
+		}
+	}
+}
+
+// add aggregates a raw sample as written by the BPF program, a key followed by the user and kernel stacks.
+func (s *sampleStream) add(raw []byte) error {
+	keySize := binary.Size(stackCountKey{})
+	if len(raw) < keySize+doubleStackDepth*8 {
+		return fmt.Errorf("sample too short: %d bytes", len(raw))
+	}
+
+	var k streamKey
+	if err := binary.Read(bytes.NewReader(raw[:keySize]), s.byteOrder, &k.key); err != nil {
+		return fmt.Errorf("read sample key: %w", err)
+	}
+	// The stack IDs hold the sizes of the stacks in bytes, or the errors of walking them.
+	user := raw[keySize : keySize+stackDepth*8]
+	kernel := raw[keySize+stackDepth*8 : keySize+doubleStackDepth*8]
+	if k.key.UserStackID > 0 {
+		for i := 0; i < int(k.key.UserStackID)/8 && i < stackDepth; i++ {
+			k.stack[i] = s.byteOrder.Uint64(user[i*8:])
+		}
+	}
+	if k.key.KernelStackID > 0 {
+		for i := 0; i < int(k.key.KernelStackID)/8 && i < stackDepth; i++ {
+			k.stack[stackDepth+i] = s.byteOrder.Uint64(kernel[i*8:])
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.counts[k]; !ok && len(s.counts) >= s.maxStacks {
+		s.metrics.streamedSamplesDropped.WithLabelValues("memory_limit").Inc()
+		return nil
+	}
+	s.counts[k]++
+	return nil
+}
+
+// forEachSample calls fn with the samples aggregated since the last call of the targeted processes.
+func (s *sampleStream) forEachSample(_ profileType, isTarget func(PID) bool, fn func(*stackSample) error) error {
+	s.mtx.Lock()
+	counts := s.counts
+	s.counts = map[streamKey]uint64{}
+	s.mtx.Unlock()
+
+	for k, count := range counts {
+		if !isTarget(PID(k.key.PID)) {
+			continue
+		}
+		sample := &stackSample{
+			key:        k.key,
+			stack:      k.stack,
+			userErr:    errNoStack,
+			kernelErr:  kernelStackIDError(k.key.KernelStackID),
+			valueBytes: make([]byte, 8),
+		}
+		if k.key.KernelThread == 0 {
+			sample.userErr = stackIDError("user", k.key.UserStackID)
+		}
+		s.byteOrder.PutUint64(sample.valueBytes, count)
+		if err := fn(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
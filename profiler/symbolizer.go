@@ -0,0 +1,63 @@
+package profiler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+)
+
+// Symbolizer resolves the functions of the locations of a profile.
+type Symbolizer interface {
+	// Symbolize adds lines to the kernel locations and to the user locations, which are keyed by PID.
+	// Locations that already have lines or can't be resolved are left untouched.
+	// It returns the functions the added lines refer to.
+	Symbolize(ctx context.Context, kernelLocations []*profile.Location, userLocations map[uint32][]*profile.Location) ([]*profile.Function, error)
+}
+
+// NewLocalSymbolizer creates the symbolizer that resolves every location on the node,
+// Go binaries using their pclntab, just-in-time compiled code using perf maps and jitdump files
+// and other object files using their symbol tables. Object files are opened through the given cache,
+// which is meant to be shared with the profiler. The debuginfod client is optional.
+func NewLocalSymbolizer(logger log.Logger, objFileCache objectfile.Cache, debuginfod *DebuginfodClient) *ChainSymbolizer {
+	return NewChainSymbolizer(
+		NewKernelSymbolizer(logger),
+		NewGoSymbolizer(logger, objFileCache),
+		NewJITSymbolizer(logger),
+		NewELFSymbolizer(logger, objFileCache, debuginfod),
+	)
+}
+
+// ChainSymbolizer runs symbolizers one after the other, each one resolving the locations the previous ones left.
+type ChainSymbolizer struct {
+	symbolizers []Symbolizer
+}
+
+func NewChainSymbolizer(symbolizers ...Symbolizer) *ChainSymbolizer {
+	return &ChainSymbolizer{symbolizers: symbolizers}
+}
+
+func (c *ChainSymbolizer) Symbolize(ctx context.Context, kernelLocations []*profile.Location, userLocations map[uint32][]*profile.Location) ([]*profile.Function, error) {
+	var functions []*profile.Function
+	for _, s := range c.symbolizers {
+		fns, err := s.Symbolize(ctx, kernelLocations, userLocations)
+		if err != nil {
+			return nil, fmt.Errorf("symbolize: %w", err)
+		}
+		functions = append(functions, fns...)
+	}
+	return functions, nil
+}
+
+// NoopSymbolizer leaves every location unresolved, e.g. to leave symbolization to the server.
+type NoopSymbolizer struct{}
+
+func NewNoopSymbolizer() *NoopSymbolizer {
+	return &NoopSymbolizer{}
+}
+
+func (NoopSymbolizer) Symbolize(context.Context, []*profile.Location, map[uint32][]*profile.Location) ([]*profile.Function, error) {
+	return nil, nil
+}
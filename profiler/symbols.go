@@ -1,37 +1,325 @@
 package profiler
 
 import (
+	"context"
+	"debug/elf"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	burrow "github.com/goburrow/cache"
 	"github.com/google/pprof/profile"
+	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
 )
 
-// resolveKernelFunctions resolves kernel function names.
-func (p *Profiler) resolveKernelFunctions(kernelLocations []*profile.Location) (map[uint64]*profile.Function, error) {
+// KernelSymbolizer resolves kernel function names using /proc/kallsyms.
+// Functions of kernel modules are labeled with the module they belong to, e.g. nf_hook_slow [nf_tables].
+type KernelSymbolizer struct {
+	logger    log.Logger
+	ksymCache *ksym.Cache
+
+	// modules identifies the kernel modules that were loaded when the cache got created.
+	modules string
+}
+
+func NewKernelSymbolizer(logger log.Logger) *KernelSymbolizer {
+	return &KernelSymbolizer{
+		logger:    logger,
+		ksymCache: ksym.NewKsymCache(logger),
+	}
+}
+
+func (s *KernelSymbolizer) Symbolize(_ context.Context, kernelLocations []*profile.Location, _ map[uint32][]*profile.Location) ([]*profile.Function, error) {
 	kernelAddresses := map[uint64]struct{}{}
 	for _, kloc := range kernelLocations {
+		if len(kloc.Line) > 0 {
+			continue
+		}
 		kernelAddresses[kloc.Address] = struct{}{}
 	}
-	kernelSymbols, err := p.ksymCache.Resolve(kernelAddresses)
+	if len(kernelAddresses) == 0 {
+		return nil, nil
+	}
+
+	s.refresh()
+	kernelSymbols, err := s.ksymCache.Resolve(kernelAddresses)
 	if err != nil {
 		return nil, fmt.Errorf("resolve kernel symbols: %w", err)
 	}
+
+	var functions []*profile.Function
 	kernelFunctions := map[uint64]*profile.Function{}
 	for _, kloc := range kernelLocations {
+		if len(kloc.Line) > 0 {
+			continue
+		}
 		kernelFunction, ok := kernelFunctions[kloc.Address]
 		if !ok {
-			name := kernelSymbols[kloc.Address]
-			if name == "" {
-				name = "not found"
+			kernelFunction = kernelFunctionAt(kloc, kernelSymbols[kloc.Address])
+			kernelFunctions[kloc.Address] = kernelFunction
+			functions = append(functions, kernelFunction)
+		}
+		kloc.Line = []profile.Line{{Function: kernelFunction}}
+	}
+	return functions, nil
+}
+
+// refresh drops the cached symbols when kernel modules got loaded or unloaded, as their symbols moved.
+func (s *KernelSymbolizer) refresh() {
+	modules, err := readKernelModules()
+	if err != nil {
+		level.Debug(s.logger).Log("msg", "failed to read kernel modules", "err", err)
+		return
+	}
+	fingerprint := kernelModulesFingerprint(modules)
+	if fingerprint == s.modules {
+		return
+	}
+	if s.modules != "" {
+		level.Debug(s.logger).Log("msg", "kernel modules changed, invalidating kernel symbols")
+		s.ksymCache = ksym.NewKsymCache(s.logger)
+	}
+	s.modules = fingerprint
+}
+
+// kernelFunctionAt returns the function of the given kernel location named after the given kallsyms symbol.
+// Locations without a symbol are named after their mapping, i.e. the core kernel or the module.
+func kernelFunctionAt(kloc *profile.Location, symbol string) *profile.Function {
+	// Symbols of modules are followed by the module name, e.g. nf_hook_slow\t[nf_tables].
+	if i := strings.IndexByte(symbol, '\t'); i >= 0 {
+		symbol = symbol[:i]
+	}
+
+	label := kernelMappingFile
+	if kloc.Mapping != nil {
+		label = kloc.Mapping.File
+	}
+	if symbol == "" {
+		return &profile.Function{Name: label}
+	}
+	if label == kernelMappingFile {
+		return &profile.Function{Name: symbol, SystemName: symbol}
+	}
+	return &profile.Function{Name: symbol + " " + label, SystemName: symbol}
+}
+
+// elfSymbol is a function symbol of an object file.
+type elfSymbol struct {
+	start, end uint64
+	name       string
+}
+
+// elfSymbols holds the function symbols of an object file, sorted by address.
+type elfSymbols []elfSymbol
+
+// readELFSymbols reads the function symbols of .symtab and .dynsym of the given ELF files,
+// e.g. of an object file and of its separate debug info. The first name of an address wins.
+func readELFSymbols(paths ...string) (elfSymbols, error) {
+	var syms []elf.Symbol
+	for _, path := range paths {
+		s, err := readELFFunctionSymbols(path)
+		if err != nil {
+			return nil, err
+		}
+		syms = append(syms, s...)
+	}
+
+	seen := map[uint64]struct{}{}
+	symbols := make(elfSymbols, 0, len(syms))
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 {
+			continue
+		}
+		// .dynsym mostly repeats .symtab.
+		if _, ok := seen[sym.Value]; ok {
+			continue
+		}
+		seen[sym.Value] = struct{}{}
+		symbols = append(symbols, elfSymbol{start: sym.Value, end: sym.Value + sym.Size, name: sym.Name})
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].start < symbols[j].start })
+
+	// Symbols without a size extend to the next one.
+	for i := range symbols {
+		if symbols[i].end == symbols[i].start && i+1 < len(symbols) {
+			symbols[i].end = symbols[i+1].start
+		}
+	}
+	return symbols, nil
+}
+
+func readELFFunctionSymbols(path string) ([]elf.Symbol, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open elf file: %w", err)
+	}
+	defer f.Close()
+
+	var syms []elf.Symbol
+	for _, read := range []func() ([]elf.Symbol, error){f.Symbols, f.DynamicSymbols} {
+		s, err := read()
+		if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+			return nil, fmt.Errorf("read symbols: %w", err)
+		}
+		syms = append(syms, s...)
+	}
+	return syms, nil
+}
+
+// hasSymbolTable reports whether the given ELF file has a .symtab section, i.e. isn't stripped.
+func hasSymbolTable(path string) (bool, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("open elf file: %w", err)
+	}
+	defer f.Close()
+	return f.Section(".symtab") != nil, nil
+}
+
+// lookup returns the name of the function that contains the given address.
+func (s elfSymbols) lookup(addr uint64) (string, bool) {
+	i := sort.Search(len(s), func(i int) bool { return s[i].start > addr }) - 1
+	if i < 0 || addr >= s[i].end && s[i].end != s[i].start {
+		return "", false
+	}
+	return s[i].name, true
+}
+
+// objectFileKey returns the cache key of the symbols of the given object file.
+func objectFileKey(objFile *objectfile.MappedObjectFile) string {
+	if objFile.BuildID != "" {
+		return objFile.BuildID
+	}
+	return objFile.Path
+}
+
+// symbolizable reports whether the given user location is left to be symbolized.
+func symbolizable(loc *profile.Location) bool {
+	return loc.Mapping != nil && !loc.Mapping.Unsymbolizable() && len(loc.Line) == 0
+}
+
+// userFunctions deduplicates the functions of user object files.
+type userFunctions struct {
+	functions []*profile.Function
+	byID      map[[3]string]*profile.Function
+}
+
+func newUserFunctions() *userFunctions {
+	return &userFunctions{byID: map[[3]string]*profile.Function{}}
+}
+
+func (u *userFunctions) get(m *profile.Mapping, name, filename string, startLine int64) *profile.Function {
+	key := [3]string{m.File, name, filename}
+	f, ok := u.byID[key]
+	if !ok {
+		f = &profile.Function{Name: name, SystemName: name, Filename: filename, StartLine: startLine}
+		u.byID[key] = f
+		u.functions = append(u.functions, f)
+	}
+	return f
+}
+
+// ELFSymbolizer resolves the function names of user locations using the symbol tables of their object files.
+// The symbol tables of stripped object files are fetched from debuginfod servers, when a client is given.
+// The addresses of the locations are expected to be normalized.
+type ELFSymbolizer struct {
+	logger       log.Logger
+	objFileCache objectfile.Cache
+	symbolCache  burrow.Cache
+	debuginfod   *DebuginfodClient
+}
+
+// objectSymbols are the cached symbols of an object file.
+type objectSymbols struct {
+	symbols elfSymbols
+	// retryAt is when to look for the debug info of the stripped object file again,
+	// it is zero when there is nothing to look for.
+	retryAt time.Time
+}
+
+// NewELFSymbolizer creates an ELF symbolizer that opens object files through the given cache,
+// which is meant to be shared with the profiler. The debuginfod client is optional.
+func NewELFSymbolizer(logger log.Logger, objFileCache objectfile.Cache, debuginfod *DebuginfodClient) *ELFSymbolizer {
+	return &ELFSymbolizer{
+		logger:       logger,
+		objFileCache: objFileCache,
+		symbolCache:  burrow.New(burrow.WithMaximumSize(32)),
+		debuginfod:   debuginfod,
+	}
+}
+
+func (s *ELFSymbolizer) Symbolize(ctx context.Context, _ []*profile.Location, userLocations map[uint32][]*profile.Location) ([]*profile.Function, error) {
+	functions := newUserFunctions()
+	for pid, locations := range userLocations {
+		for _, loc := range locations {
+			if !symbolizable(loc) {
+				continue
 			}
-			kernelFunction = &profile.Function{
-				Name: name,
+			m := loc.Mapping
+
+			symbols, err := s.symbols(ctx, pid, m)
+			if err != nil {
+				level.Debug(s.logger).Log("msg", "failed to read symbols", "pid", pid, "file", m.File, "err", err)
+				continue
 			}
-			kernelFunctions[kloc.Address] = kernelFunction
+			name, ok := symbols.lookup(loc.Address)
+			if !ok {
+				continue
+			}
+			loc.Line = []profile.Line{{Function: functions.get(m, name, "", 0)}}
+			m.HasFunctions = true
 		}
-		if kernelFunction != nil {
-			kloc.Line = []profile.Line{{Function: kernelFunction}}
+	}
+	return functions.functions, nil
+}
+
+// symbols returns the function symbols of the object file behind the given mapping of a process.
+func (s *ELFSymbolizer) symbols(ctx context.Context, pid uint32, m *profile.Mapping) (elfSymbols, error) {
+	objFile, err := s.objFileCache.ObjectFileForProcess(pid, m)
+	if err != nil {
+		return nil, err
+	}
+	key := objectFileKey(objFile)
+	if val, ok := s.symbolCache.GetIfPresent(key); ok {
+		//nolint:forcetypeassert
+		cached := val.(*objectSymbols)
+		if cached.retryAt.IsZero() || time.Now().Before(cached.retryAt) {
+			return cached.symbols, nil
+		}
+	}
+
+	paths := []string{objFile.Path}
+	var retryAt time.Time
+	if s.debuginfod != nil && objFile.BuildID != "" {
+		ok, err := hasSymbolTable(objFile.Path)
+		if err != nil {
+			return nil, err
 		}
+		if !ok {
+			debugInfo, err := s.debuginfod.DebugInfo(ctx, objFile.BuildID)
+			switch {
+			case errors.Is(err, errDebugInfoPending):
+				// Look again once the fetch had time to finish.
+				retryAt = time.Now().Add(debuginfodPendingRetryInterval)
+			case err != nil:
+				level.Debug(s.logger).Log("msg", "no debug info for stripped object file", "file", m.File, "buildID", objFile.BuildID, "err", err)
+				retryAt = time.Now().Add(debuginfodRetryInterval)
+			default:
+				// The symbol table of the debug info takes precedence over the dynamic symbols of the object file.
+				paths = []string{debugInfo, objFile.Path}
+			}
+		}
+	}
+
+	symbols, err := readELFSymbols(paths...)
+	if err != nil {
+		return nil, err
 	}
-	return kernelFunctions, nil
+	s.symbolCache.Put(key, &objectSymbols{symbols: symbols, retryAt: retryAt})
+	return symbols, nil
 }
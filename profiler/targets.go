@@ -0,0 +1,129 @@
+package profiler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/google/gops/goprocess"
+)
+
+// TargetMode decides which of the sampled processes end up in the written profiles.
+type TargetMode string
+
+const (
+	// TargetAll profiles every process on the host.
+	TargetAll TargetMode = "all"
+	// TargetGo profiles only the processes that are Go binaries.
+	TargetGo TargetMode = "go"
+	// TargetPIDs profiles only an explicit list of processes.
+	TargetPIDs TargetMode = "pids"
+)
+
+// ParseTargetMode validates the given target selection mode.
+func ParseTargetMode(s string) (TargetMode, error) {
+	switch m := TargetMode(s); m {
+	case TargetAll, TargetGo, TargetPIDs:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown target mode %q", s)
+	}
+}
+
+type targets struct {
+	mode TargetMode
+	pids map[PID]struct{}
+}
+
+func newTargets(mode TargetMode, pids []int) *targets {
+	t := &targets{mode: mode, pids: map[PID]struct{}{}}
+	for _, pid := range pids {
+		t.pids[PID(pid)] = struct{}{}
+	}
+	return t
+}
+
+// probePID returns the PID uprobes on a file mapped by the given process are restricted to.
+// Outside of the pids target mode, probes fire for every process and are filtered later.
+func (t *targets) probePID(pid PID) int {
+	if t.mode == TargetPIDs {
+		return int(pid)
+	}
+	return -1
+}
+
+// candidatePIDs returns the processes to probe, the listed ones in the pids target mode and every process otherwise.
+func (t *targets) candidatePIDs() ([]PID, error) {
+	var pids []PID
+	if t.mode == TargetPIDs {
+		for pid := range t.pids {
+			pids = append(pids, pid)
+		}
+		return pids, nil
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("list processes: %w", err)
+	}
+	for _, e := range entries {
+		pid, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		pids = append(pids, PID(pid))
+	}
+	return pids, nil
+}
+
+// targetMatcher returns a predicate that reports whether the given process should be profiled.
+// It is meant to be created once per profiling loop.
+func (p *Profiler) targetMatcher() func(PID) bool {
+	switch p.targets.mode {
+	case TargetGo:
+		goProcesses := map[PID]struct{}{}
+		for _, ps := range goprocess.FindAll() {
+			level.Debug(p.logger).Log("msg", "attaching profiler to processes", "pid", ps.PID, "path", ps.Path)
+			goProcesses[PID(ps.PID)] = struct{}{}
+		}
+		return func(pid PID) bool {
+			_, ok := goProcesses[pid]
+			return ok
+		}
+	case TargetPIDs:
+		return func(pid PID) bool {
+			_, ok := p.targets.pids[pid]
+			return ok
+		}
+	default:
+		return func(pid PID) bool {
+			return pid != 0
+		}
+	}
+}
+
+// processLabels returns the metadata labels of the given process.
+// Go processes are identified by goprocess, everything else is described using /proc.
+func processLabels(pid PID) map[string]string {
+	labels := map[string]string{}
+
+	ps, ok, _ := goprocess.Find(int(pid))
+	if ok {
+		labels["exec"] = ps.Exec
+		labels["path"] = ps.Path
+		labels["build_version"] = ps.BuildVersion
+		return labels
+	}
+
+	procDir := filepath.Join("/proc", fmt.Sprintf("%d", pid))
+	if comm, err := os.ReadFile(filepath.Join(procDir, "comm")); err == nil {
+		labels["exec"] = strings.TrimSpace(string(comm))
+	}
+	if path, err := os.Readlink(filepath.Join(procDir, "exe")); err == nil {
+		labels["path"] = path
+	}
+	return labels
+}
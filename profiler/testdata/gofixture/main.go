@@ -0,0 +1,37 @@
+// Command gofixture is built by the tests of the Go symbolizer.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func add(a, b int) int {
+	return a + b // inlined
+}
+
+//go:noinline
+func compute(n int) int {
+	total := 0
+	for i := 0; i < n; i++ {
+		total = add(total, i)
+	}
+	return total
+}
+
+type counter struct {
+	n int
+}
+
+//go:noinline
+func (c *counter) inc() {
+	c.n++
+}
+
+func main() {
+	c := &counter{}
+	for i := 0; i < len(os.Args); i++ {
+		c.inc()
+	}
+	fmt.Println(compute(c.n))
+}
@@ -0,0 +1,272 @@
+package profiler
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	burrow "github.com/goburrow/cache"
+	"github.com/google/gops/goprocess"
+	"github.com/parca-dev/parca-agent/pkg/buildid"
+)
+
+const (
+	unwindTablesMapName     = "unwind_tables"
+	dwarfStackTracesMapName = "dwarf_stack_traces"
+	dwarfUnwindingConstName = "dwarf_unwinding"
+
+	// dwarfUnwindingSupported is whether the BPF programs can walk stacks using unwind tables,
+	// the unwind rows describe the registers of x86_64 only.
+	dwarfUnwindingSupported = runtime.GOARCH == "amd64"
+
+	maxUnwindTableSize = 100000 // Always needs to be sync with MAX_UNWIND_TABLE_SIZE in BPF program.
+	maxUnwindProcesses = 16     // Always needs to be sync with MAX_UNWIND_PROCESSES in BPF program.
+
+	// unwindFileRowsCacheSize is the amount of object files whose unwind rows are kept, processes share
+	// their libraries, so a few more than the processes with a table.
+	unwindFileRowsCacheSize = 64
+)
+
+// unwindTables keeps the in-kernel unwind tables of the processes whose user stacks are walked using DWARF
+// call frame information, for binaries that are built without frame pointers.
+type unwindTables struct {
+	logger    log.Logger
+	byteOrder binary.ByteOrder
+	tables    *bpf.BPFMap
+
+	// fileRows caches the unwind rows of object files by build ID.
+	fileRows burrow.Cache
+	// loaded maps the processes with a table to the mappings the table was built from.
+	loaded map[PID]string
+	// skipped are the processes that don't need or can't have a table.
+	skipped map[PID]struct{}
+}
+
+func newUnwindTables(logger log.Logger, byteOrder binary.ByteOrder, tables *bpf.BPFMap) *unwindTables {
+	return &unwindTables{
+		logger:    logger,
+		byteOrder: byteOrder,
+		tables:    tables,
+		fileRows:  burrow.New(burrow.WithMaximumSize(unwindFileRowsCacheSize)),
+		loaded:    map[PID]string{},
+		skipped:   map[PID]struct{}{},
+	}
+}
+
+// executableMapping is a file backed executable memory mapping of a process.
+type executableMapping struct {
+	start, end, offset uint64
+	path               string
+}
+
+// update drops the tables of exited processes, rebuilds the ones whose mappings changed,
+// e.g. because of dlopen, and adds tables for the given processes while there is room.
+func (u *unwindTables) update(candidates []PID) {
+	for pid, fingerprint := range u.loaded {
+		mappings, err := executableMappings(pid)
+		if err != nil {
+			u.remove(pid)
+			continue
+		}
+		if mappingsFingerprint(mappings) != fingerprint {
+			if err := u.load(pid, mappings); err != nil {
+				level.Debug(u.logger).Log("msg", "failed to rebuild unwind table", "pid", pid, "err", err)
+				u.remove(pid)
+			}
+		}
+	}
+	for pid := range u.skipped {
+		if _, err := os.Stat(filepath.Join("/proc", fmt.Sprintf("%d", pid))); err != nil {
+			delete(u.skipped, pid)
+		}
+	}
+
+	for _, pid := range candidates {
+		if len(u.loaded) >= maxUnwindProcesses {
+			level.Debug(u.logger).Log("msg", "no room for more unwind tables", "max", maxUnwindProcesses)
+			return
+		}
+		if _, ok := u.loaded[pid]; ok {
+			continue
+		}
+		if _, ok := u.skipped[pid]; ok {
+			continue
+		}
+		// Go binaries always keep frame pointers.
+		if _, ok, _ := goprocess.Find(int(pid)); ok {
+			u.skipped[pid] = struct{}{}
+			continue
+		}
+
+		mappings, err := executableMappings(pid)
+		if err == nil {
+			err = u.load(pid, mappings)
+		}
+		if err != nil {
+			level.Debug(u.logger).Log("msg", "failed to build unwind table", "pid", pid, "err", err)
+			u.skipped[pid] = struct{}{}
+			continue
+		}
+		level.Debug(u.logger).Log("msg", "loaded unwind table", "pid", pid)
+	}
+}
+
+// load builds the unwind table of the given process and stores it in the BPF map.
+func (u *unwindTables) load(pid PID, mappings []executableMapping) error {
+	var rows []unwindRow
+	for _, m := range mappings {
+		mappingRows, err := u.mappingRows(pid, m)
+		if err != nil {
+			level.Debug(u.logger).Log("msg", "no unwind information for mapping", "pid", pid, "path", m.path, "err", err)
+			continue
+		}
+		rows = append(rows, mappingRows...)
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("no unwind information found")
+	}
+
+	rows = compactRows(rows)
+	if len(rows) > maxUnwindTableSize {
+		level.Warn(u.logger).Log("msg", "unwind table truncated", "pid", pid, "rows", len(rows), "max", maxUnwindTableSize)
+		rows = rows[:maxUnwindTableSize]
+	}
+
+	// The map value always has room for the maximum amount of rows.
+	valueSize := 8 + maxUnwindTableSize*int(unsafe.Sizeof(unwindRow{}))
+	buf := bytes.NewBuffer(make([]byte, 0, valueSize))
+	if err := binary.Write(buf, u.byteOrder, uint64(len(rows))); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, u.byteOrder, rows); err != nil {
+		return err
+	}
+	value := make([]byte, valueSize)
+	copy(value, buf.Bytes())
+
+	key := uint32(pid)
+	if err := u.tables.Update(unsafe.Pointer(&key), unsafe.Pointer(&value[0])); err != nil {
+		return fmt.Errorf("update unwind tables: %w", err)
+	}
+	u.loaded[pid] = mappingsFingerprint(mappings)
+	return nil
+}
+
+func (u *unwindTables) close() error {
+	return u.fileRows.Close()
+}
+
+func (u *unwindTables) remove(pid PID) {
+	key := uint32(pid)
+	if err := u.tables.DeleteKey(unsafe.Pointer(&key)); err != nil {
+		level.Debug(u.logger).Log("msg", "failed to delete unwind table", "pid", pid, "err", err)
+	}
+	delete(u.loaded, pid)
+}
+
+// mappingRows returns the unwind rows of the given mapping, at the addresses it is mapped at.
+func (u *unwindTables) mappingRows(pid PID, m executableMapping) ([]unwindRow, error) {
+	path := filepath.Join("/proc", fmt.Sprintf("%d", pid), "root", m.path)
+	buildID, err := buildid.BuildID(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []unwindRow
+	if cached, ok := u.fileRows.GetIfPresent(buildID); ok {
+		rows = cached.([]unwindRow)
+	} else {
+		rows, err = readUnwindRows(f)
+		if err != nil {
+			return nil, err
+		}
+		u.fileRows.Put(buildID, rows)
+	}
+
+	// Find the segment the mapping maps to translate the addresses of the file.
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		if m.offset < prog.Off || m.offset >= prog.Off+prog.Filesz {
+			continue
+		}
+		bias := m.start - m.offset + prog.Off - prog.Vaddr
+
+		mapped := make([]unwindRow, 0, len(rows))
+		for _, row := range rows {
+			row.PC += bias
+			if row.PC < m.start || row.PC >= m.end {
+				continue
+			}
+			mapped = append(mapped, row)
+		}
+		return mapped, nil
+	}
+	return nil, fmt.Errorf("no executable segment at offset %#x", m.offset)
+}
+
+// executableMappings returns the file backed executable mappings of the given process.
+func executableMappings(pid PID) ([]executableMapping, error) {
+	f, err := os.Open(filepath.Join("/proc", fmt.Sprintf("%d", pid), "maps"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mappings []executableMapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line looks like address perms offset dev inode pathname.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.Contains(fields[1], "x") || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		addrs := strings.SplitN(fields[0], "-", 2)
+		if len(addrs) != 2 {
+			continue
+		}
+		start, err := strconv.ParseUint(addrs[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseUint(addrs[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		offset, err := strconv.ParseUint(fields[2], 16, 64)
+		if err != nil {
+			continue
+		}
+		mappings = append(mappings, executableMapping{start: start, end: end, offset: offset, path: fields[5]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+func mappingsFingerprint(mappings []executableMapping) string {
+	var b strings.Builder
+	for _, m := range mappings {
+		fmt.Fprintf(&b, "%x-%x %x %s\n", m.start, m.end, m.offset, m.path)
+	}
+	return b.String()
+}
@@ -0,0 +1,17 @@
+// vmlinux.h is generated from an x86_64 kernel, this adds the types of arm64
+// the BPF programs need. They are part of the kernel UAPI, so they don't change
+// between kernel versions.
+
+#ifndef __VMLINUX_ARM64_H__
+#define __VMLINUX_ARM64_H__
+
+// The user space registers, the uprobe argument macros of bpf_tracing.h read
+// them on arm64.
+struct user_pt_regs {
+  __u64 regs[31];
+  __u64 sp;
+  __u64 pc;
+  __u64 pstate;
+};
+
+#endif /* __VMLINUX_ARM64_H__ */